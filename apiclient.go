@@ -0,0 +1,366 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/openai/openai-go"
+	"github.com/openai/openai-go/option"
+)
+
+const (
+	keySelectionRoundRobin = "round-robin"
+	keySelectionLeastSpend = "least-spend"
+)
+
+// How long a key is not used after it failed.
+const apiKeyQuotaCooldown = time.Hour
+const apiKeyRateLimitCooldown = time.Minute
+
+type apiKeyConfigType struct {
+	Key          string
+	Organization string
+	Project      string
+}
+
+type apiKeyType struct {
+	apiKeyConfigType
+	client openai.Client
+
+	unhealthyUntil time.Time
+	lastError      string
+	requests       int
+	spend          float64 // Estimated spend in USD.
+}
+
+// maskedKey returns the key in a form which is safe to show.
+func (k *apiKeyType) maskedKey() string {
+	if len(k.Key) < 12 {
+		return "***"
+	}
+	return k.Key[:3] + "..." + k.Key[len(k.Key)-4:]
+}
+
+// id returns an identifier of the key which can be stored without storing the key itself.
+func (k *apiKeyType) id() string {
+	h := sha256.Sum256([]byte(k.Key))
+	return hex.EncodeToString(h[:8])
+}
+
+// coster is implemented by API responses which can tell their cost.
+type coster interface {
+	Cost() float64
+}
+
+// apiClientType sends API requests using multiple keys, failing over to the next key if one gets rate
+// limited or runs out of quota.
+type apiClientType struct {
+	mutex     sync.Mutex
+	keys      []*apiKeyType
+	next      int
+	spendFile string
+}
+
+var apiClient apiClientType
+
+// parseAPIKeys parses the "key:organization:project,key:organization:project" format. Organization and
+// project are optional.
+func parseAPIKeys(s string) (keys []apiKeyConfigType, err error) {
+	for _, item := range strings.Split(s, ",") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+		parts := strings.Split(item, ":")
+		if len(parts) > 3 || parts[0] == "" {
+			return nil, fmt.Errorf("invalid api key setting: %s", item)
+		}
+		k := apiKeyConfigType{Key: parts[0]}
+		if len(parts) > 1 {
+			k.Organization = parts[1]
+		}
+		if len(parts) > 2 {
+			k.Project = parts[2]
+		}
+		keys = append(keys, k)
+	}
+	return
+}
+
+// parseHeaders parses the "Name:value,Name:value" format.
+func parseHeaders(s string) (headers map[string]string, err error) {
+	headers = make(map[string]string)
+	for _, item := range strings.Split(s, ",") {
+		if strings.TrimSpace(item) == "" {
+			continue
+		}
+		name, value, found := strings.Cut(item, ":")
+		name = strings.TrimSpace(name)
+		if !found || name == "" {
+			return nil, fmt.Errorf("invalid header setting: %s", item)
+		}
+		headers[name] = strings.TrimSpace(value)
+	}
+	return
+}
+
+// newOpenAIClient creates a client for the given operator key using the configured endpoint, headers and
+// proxy.
+func newOpenAIClient(kc apiKeyConfigType) openai.Client {
+	var opts []option.RequestOption
+	if params.AzureAPIVersion != "" {
+		// Azure uses the api-key header for authentication, and the API version as a query param.
+		opts = append(opts,
+			option.WithBaseURL(strings.TrimSuffix(params.OpenAIBaseURL, "/")+"/openai/"),
+			option.WithQueryAdd("api-version", params.AzureAPIVersion),
+			option.WithHeaderDel("authorization"),
+			option.WithHeader("api-key", kc.Key),
+		)
+	} else {
+		opts = append(opts, option.WithAPIKey(kc.Key))
+		if params.OpenAIBaseURL != "" {
+			opts = append(opts, option.WithBaseURL(params.OpenAIBaseURL))
+		}
+	}
+	if kc.Organization != "" {
+		opts = append(opts, option.WithOrganization(kc.Organization))
+	}
+	if kc.Project != "" {
+		opts = append(opts, option.WithProject(kc.Project))
+	}
+	for name, value := range params.OpenAIHeaders {
+		opts = append(opts, option.WithHeader(name, value))
+	}
+	if params.OpenAIProxy != nil {
+		opts = append(opts, option.WithHTTPClient(&http.Client{
+			Transport: &http.Transport{Proxy: http.ProxyURL(params.OpenAIProxy)},
+		}))
+	}
+	return openai.NewClient(opts...)
+}
+
+// newCustomKeyClient creates a client for a custom key of a user or group. The operator's endpoint, headers
+// and proxy are not used, as they may be specific to the operator keys or leak operator data to OpenAI.
+func newCustomKeyClient(key string) openai.Client {
+	return openai.NewClient(option.WithAPIKey(key))
+}
+
+// getAPIPath returns the API path for the given model. On Azure, models are deployments with their own paths.
+// The path is returned as is if the model is empty.
+func getAPIPath(path, model string) string {
+	if params.AzureAPIVersion != "" && model != "" {
+		return "deployments/" + url.PathEscape(model) + "/" + path
+	}
+	return path
+}
+
+func (a *apiClientType) Init(keys []apiKeyConfigType) {
+	for _, kc := range keys {
+		a.keys = append(a.keys, &apiKeyType{
+			apiKeyConfigType: kc,
+			client:           newOpenAIClient(kc),
+		})
+	}
+
+	a.spendFile = filepath.Join(params.DataDir, "keyspend.json")
+	a.loadSpend()
+}
+
+func (a *apiClientType) loadSpend() {
+	d, err := os.ReadFile(a.spendFile)
+	if err != nil {
+		return
+	}
+	var spend map[string]float64
+	if err := json.Unmarshal(d, &spend); err != nil {
+		fmt.Println("  can't parse key spend file:", err)
+		return
+	}
+	for _, k := range a.keys {
+		k.spend = spend[k.id()]
+	}
+}
+
+// saveSpend should be called with the mutex locked.
+func (a *apiClientType) saveSpend() {
+	spend := make(map[string]float64)
+	for _, k := range a.keys {
+		spend[k.id()] = k.spend
+	}
+	d, err := json.Marshal(spend)
+	if err != nil {
+		return
+	}
+	if err := os.MkdirAll(filepath.Dir(a.spendFile), 0700); err != nil {
+		fmt.Println("  can't create data dir:", err)
+		return
+	}
+	if err := os.WriteFile(a.spendFile, d, 0600); err != nil {
+		fmt.Println("  can't save key spend:", err)
+	}
+}
+
+// selectKey returns the key to be used for the next request, skipping the given keys. Unhealthy keys are
+// only returned if there are no healthy ones.
+func (a *apiClientType) selectKey(skip []*apiKeyType) *apiKeyType {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+
+	var candidates []*apiKeyType
+	var fallback *apiKeyType
+	for i := range a.keys {
+		// Starting from the next key for round robin.
+		k := a.keys[(a.next+i)%len(a.keys)]
+		skipped := false
+		for _, s := range skip {
+			if s == k {
+				skipped = true
+				break
+			}
+		}
+		if skipped {
+			continue
+		}
+		if time.Now().Before(k.unhealthyUntil) {
+			if fallback == nil || k.unhealthyUntil.Before(fallback.unhealthyUntil) {
+				fallback = k
+			}
+			continue
+		}
+		candidates = append(candidates, k)
+	}
+
+	if len(candidates) == 0 {
+		return fallback
+	}
+
+	selected := candidates[0]
+	if params.OpenAIKeySelection == keySelectionLeastSpend {
+		for _, k := range candidates[1:] {
+			if k.spend < selected.spend {
+				selected = k
+			}
+		}
+	}
+	for i, k := range a.keys {
+		if k == selected {
+			a.next = i + 1
+			break
+		}
+	}
+	return selected
+}
+
+// getFailoverCooldown returns how long the key shouldn't be used after the given error, or 0 if the error
+// is not related to the key.
+func getFailoverCooldown(err error) time.Duration {
+	var apiErr *openai.Error
+	if !errors.As(err, &apiErr) {
+		return 0
+	}
+	switch {
+	case apiErr.Code == "insufficient_quota", apiErr.StatusCode == http.StatusUnauthorized:
+		return apiKeyQuotaCooldown
+	case apiErr.StatusCode == http.StatusTooManyRequests:
+		return apiKeyRateLimitCooldown
+	}
+	return 0
+}
+
+// Post sends the request for the given model with the custom key of the user or group if there's one,
+// otherwise with an operator key. See postWithOperatorKeys for operator key selection. Custom keys are always
+// used with the OpenAI API, so the path is only mapped to an Azure deployment for operator keys.
+func (a *apiClientType) Post(ctx context.Context, path, model string, body []byte, res any, opts ...option.RequestOption) (err error) {
+	v, ok := getAPIKeyCtxValue(ctx)
+	if !ok {
+		return a.postWithOperatorKeys(ctx, getAPIPath(path, model), body, res, opts...)
+	}
+
+	if v.customKey != nil {
+		err = v.customKey.client.Post(ctx, path, body, res, opts...)
+		if err == nil || params.CustomKeyFallback != customKeyFallbackOperator || ctx.Err() != nil {
+			return err
+		}
+		fmt.Println("    custom api key failed, falling back to operator keys:", err)
+	} else if !v.canUseOperator {
+		return fmt.Errorf("no API key set, please set one with the imagenkey command")
+	}
+	return a.postWithOperatorKeys(ctx, getAPIPath(path, model), body, res, opts...)
+}
+
+// postWithOperatorKeys sends the request with a selected key, and retries with the other keys on key related
+// errors.
+func (a *apiClientType) postWithOperatorKeys(ctx context.Context, path string, body []byte, res any, opts ...option.RequestOption) (err error) {
+	var tried []*apiKeyType
+	for {
+		k := a.selectKey(tried)
+		if k == nil {
+			return err
+		}
+		tried = append(tried, k)
+
+		err = k.client.Post(ctx, path, body, res, opts...)
+
+		a.mutex.Lock()
+		k.requests++
+		if err == nil {
+			k.lastError = ""
+			if c, ok := res.(coster); ok {
+				k.spend += c.Cost()
+				a.saveSpend()
+			}
+			a.mutex.Unlock()
+			return nil
+		}
+		k.lastError = err.Error()
+		cooldown := getFailoverCooldown(err)
+		if cooldown > 0 {
+			k.unhealthyUntil = time.Now().Add(cooldown)
+		}
+		a.mutex.Unlock()
+
+		if cooldown == 0 || ctx.Err() != nil {
+			return err
+		}
+		fmt.Println("    api key", k.maskedKey(), "failed, trying next key:", err)
+	}
+}
+
+// GetStatus returns a human readable status of all keys.
+func (a *apiClientType) GetStatus() string {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+
+	var sb strings.Builder
+	for i, k := range a.keys {
+		fmt.Fprintf(&sb, "%d. %s", i+1, k.maskedKey())
+		if k.Organization != "" {
+			sb.WriteString(" org: " + k.Organization)
+		}
+		if k.Project != "" {
+			sb.WriteString(" project: " + k.Project)
+		}
+		if time.Now().Before(k.unhealthyUntil) {
+			sb.WriteString("\n  ❌ unhealthy until " + k.unhealthyUntil.Format("15:04:05"))
+		} else {
+			sb.WriteString("\n  ✅ healthy")
+		}
+		fmt.Fprintf(&sb, ", requests: %d, spend: $%.2f", k.requests, k.spend)
+		if k.lastError != "" {
+			sb.WriteString("\n  last error: " + k.lastError)
+		}
+		sb.WriteString("\n")
+	}
+	return sb.String()
+}
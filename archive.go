@@ -0,0 +1,107 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/go-telegram/bot"
+	"github.com/go-telegram/bot/models"
+	"golang.org/x/exp/slices"
+)
+
+// isArchivingEnabled returns true if the generations of the given chat should be mirrored to the archive
+// chat. The chat is nil for inline mode generations.
+func isArchivingEnabled(chat *models.Chat) bool {
+	if params.ArchiveChatID == 0 {
+		return false
+	}
+	if chat == nil {
+		return true
+	}
+	if chat.Type == models.ChatTypePrivate {
+		return !params.ArchiveSkipPrivate
+	}
+	return !slices.Contains(params.ArchiveExcludeGroupIDs, chat.ID)
+}
+
+// getArchiveCaption returns the caption of the archived images with the requester and the source chat added
+// to the given description.
+func getArchiveCaption(description string, user *models.User, chat *models.Chat) string {
+	requester := strings.TrimSpace(user.FirstName + " " + user.LastName)
+	if user.Username != "" {
+		requester += " @" + user.Username
+	}
+	s := fmt.Sprintf("%s\n👤 %s (%d)", description, requester, user.ID)
+
+	switch {
+	case chat == nil:
+		s += "\n💬 Inline mode"
+	case chat.Type == models.ChatTypePrivate:
+		s += "\n💬 Private chat"
+	default:
+		s += fmt.Sprintf("\n💬 %s (%d)", chat.Title, chat.ID)
+	}
+
+	return truncateText(s, 1024)
+}
+
+// archiveResults mirrors the already uploaded images to the archive chat by their file IDs, so they don't
+// have to be uploaded again.
+func archiveResults(ctx context.Context, user *models.User, chat *models.Chat, description string, msgs []*models.Message) {
+	if !isArchivingEnabled(chat) {
+		return
+	}
+	caption := getArchiveCaption(description, user, chat)
+
+	var media []models.InputMedia
+	for _, msg := range msgs {
+		if msg == nil {
+			continue
+		}
+		if len(msg.Photo) > 0 {
+			media = append(media, &models.InputMediaPhoto{Media: msg.Photo[len(msg.Photo)-1].FileID})
+		} else if msg.Document != nil {
+			media = append(media, &models.InputMediaDocument{Media: msg.Document.FileID})
+		}
+	}
+	if len(media) == 0 {
+		return
+	}
+
+	var err error
+	if len(media) == 1 {
+		switch m := media[0].(type) {
+		case *models.InputMediaPhoto:
+			_, err = telegramBot.SendPhoto(ctx, &bot.SendPhotoParams{
+				ChatID:  params.ArchiveChatID,
+				Photo:   &models.InputFileString{Data: m.Media},
+				Caption: caption,
+			})
+		case *models.InputMediaDocument:
+			_, err = telegramBot.SendDocument(ctx, &bot.SendDocumentParams{
+				ChatID:   params.ArchiveChatID,
+				Document: &models.InputFileString{Data: m.Media},
+				Caption:  caption,
+			})
+		}
+	} else {
+		// Captions of photo groups are shown under the first photo, and of document groups under the last
+		// document.
+		switch m := media[0].(type) {
+		case *models.InputMediaPhoto:
+			m.Caption = caption
+		case *models.InputMediaDocument:
+			media[len(media)-1].(*models.InputMediaDocument).Caption = caption
+		}
+		_, err = telegramBot.SendMediaGroup(ctx, &bot.SendMediaGroupParams{
+			ChatID: params.ArchiveChatID,
+			Media:  media,
+		})
+	}
+	if err != nil {
+		fmt.Println("    archive error:", err)
+		return
+	}
+	fmt.Println("    images archived")
+}
@@ -0,0 +1,155 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-telegram/bot"
+	"github.com/go-telegram/bot/models"
+)
+
+const callbackDataPrefix = "cb:"
+const callbackExpireAfter = 24 * time.Hour
+
+type callbackFuncType func(ctx context.Context, cq *models.CallbackQuery, msg *models.Message)
+
+type callbackEntryType struct {
+	createdAt time.Time
+	fn        callbackFuncType
+}
+
+// As Telegram limits callback data to 64 bytes, buttons only carry an ID, and the action to run is stored here.
+type callbackHandlerType struct {
+	mutex   sync.Mutex
+	nextID  int
+	entries map[int]callbackEntryType
+}
+
+var callbackHandler callbackHandlerType
+
+// Register stores the given function and returns the callback data to be used for the inline keyboard button.
+func (c *callbackHandlerType) Register(fn callbackFuncType) string {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if c.entries == nil {
+		c.entries = make(map[int]callbackEntryType)
+	}
+	for id, e := range c.entries {
+		if time.Since(e.createdAt) > callbackExpireAfter {
+			delete(c.entries, id)
+		}
+	}
+
+	c.nextID++
+	c.entries[c.nextID] = callbackEntryType{
+		createdAt: time.Now(),
+		fn:        fn,
+	}
+	return callbackDataPrefix + strconv.Itoa(c.nextID)
+}
+
+func (c *callbackHandlerType) answer(ctx context.Context, cq *models.CallbackQuery, text string) {
+	_, err := telegramBot.AnswerCallbackQuery(ctx, &bot.AnswerCallbackQueryParams{
+		CallbackQueryID: cq.ID,
+		Text:            text,
+	})
+	if err != nil {
+		fmt.Println("  answer callback query error:", err)
+	}
+}
+
+func (c *callbackHandlerType) HandleCallbackQuery(ctx context.Context, cq *models.CallbackQuery) {
+	fmt.Print("callback query from ", cq.From.Username, "#", cq.From.ID, ": ", cq.Data, "\n")
+
+	msg := cq.Message.Message
+	if msg == nil {
+		fmt.Println("  message is inaccessible, ignoring")
+		c.answer(ctx, cq, "")
+		return
+	}
+
+	if !isAllowed(msg.Chat.ID, cq.From.ID) {
+		fmt.Println("  not allowed, ignoring")
+		c.answer(ctx, cq, "")
+		return
+	}
+
+	id, err := strconv.Atoi(strings.TrimPrefix(cq.Data, callbackDataPrefix))
+	if err != nil || !strings.HasPrefix(cq.Data, callbackDataPrefix) {
+		fmt.Println("  invalid callback data")
+		c.answer(ctx, cq, "")
+		return
+	}
+
+	c.mutex.Lock()
+	e, ok := c.entries[id]
+	c.mutex.Unlock()
+
+	if !ok {
+		fmt.Println("  callback expired")
+		c.answer(ctx, cq, "❌ This button has expired")
+		return
+	}
+
+	c.answer(ctx, cq, "")
+	e.fn(customKeys.WithContext(ctx, msg.Chat.ID, cq.From.ID), cq, msg)
+}
+
+// confirm replies with the given text and Confirm and Cancel buttons, and runs fn with a new command handler
+// for the same command message if the sender of the command confirms. The buttons get removed after either
+// of them is pressed.
+func (c *cmdHandlerType) confirm(ctx context.Context, text, confirmButtonText string, fn func(ctx context.Context, c *cmdHandlerType)) {
+	var mutex sync.Mutex
+	done := false
+	handle := func(ctx context.Context, cq *models.CallbackQuery, msg *models.Message, confirmed bool) {
+		if cq.From.ID != c.cmdMsg.From.ID {
+			fmt.Println("  only the requester can confirm, ignoring")
+			return
+		}
+		mutex.Lock()
+		if done {
+			mutex.Unlock()
+			return
+		}
+		done = true
+		mutex.Unlock()
+
+		result := "❌ Canceled"
+		if confirmed {
+			result = "✅ Confirmed"
+		}
+		fmt.Println("  confirmed:", confirmed)
+		_, err := telegramBot.EditMessageText(ctx, &bot.EditMessageTextParams{
+			ChatID:    msg.Chat.ID,
+			MessageID: msg.ID,
+			Text:      text + "\n\n" + result,
+		})
+		if err != nil {
+			fmt.Println("  edit message error:", err)
+		}
+		if confirmed {
+			// The original handler is gone by now, so a new one is needed for the results.
+			cmdHandler, removeCmdHandler := addCmdHandler(c.cmdMsg)
+			defer removeCmdHandler()
+			fn(ctx, cmdHandler)
+		}
+	}
+
+	confirmData := callbackHandler.Register(func(ctx context.Context, cq *models.CallbackQuery, msg *models.Message) {
+		handle(ctx, cq, msg, true)
+	})
+	cancelData := callbackHandler.Register(func(ctx context.Context, cq *models.CallbackQuery, msg *models.Message) {
+		handle(ctx, cq, msg, false)
+	})
+	_, _ = sendReplyToMessageWithMarkup(ctx, c.cmdMsg, text,
+		&models.InlineKeyboardMarkup{
+			InlineKeyboard: [][]models.InlineKeyboardButton{
+				{{Text: confirmButtonText, CallbackData: confirmData}, {Text: "❌ Cancel", CallbackData: cancelData}},
+			},
+		})
+}
@@ -23,10 +23,31 @@ type ImageFilesDataType struct {
 	MimeType string
 }
 
+type imagenArgsType struct {
+	ArgsPresent   []string `json:"args_present,omitempty"`
+	N             int      `json:"n"`
+	Prompt        string   `json:"prompt"`
+	Model         string   `json:"model,omitempty"` // Empty for the default model.
+	Size          string   `json:"size,omitempty"`
+	Background    string   `json:"background,omitempty"`
+	Quality       string   `json:"quality,omitempty"`
+	Style         string   `json:"style,omitempty"`
+	Preset        string   `json:"preset,omitempty"`  // Name of the applied style preset.
+	Variant       string   `json:"variant,omitempty"` // Prompt matrix variant number and label.
+	Exact         string   `json:"exact,omitempty"`   // Aspect ratio ("W:H") or size ("WxH") the output gets cropped/resized to.
+	Upscale       int      `json:"upscale,omitempty"` // Upscale factor, 0 if no upscaling is needed.
+	Sharpen       bool     `json:"sharpen,omitempty"`
+	Mask          []byte   `json:"-"`                        // PNG edit mask, transparent where the image should be edited. Journaled as a file.
+	RemoveBg      bool     `json:"remove_bg,omitempty"`      // The result should be a transparent cut-out sent as a document.
+	Grid          bool     `json:"grid,omitempty"`           // Multiple results are sent as one grid image.
+	EstimatedCost float64  `json:"estimated_cost,omitempty"` // Set if the requester confirmed the estimated cost.
+}
+
 type cmdHandlerType struct {
 	cmdMsg            *models.Message
 	expectImageFromID int64
 	expectImageChan   chan ImageFilesDataType
+	expectRawImages   bool // Posted images are passed without preprocessing.
 }
 
 func (c *cmdHandlerType) reply(ctx context.Context, text string) (replyMsg *models.Message, err error) {
@@ -36,47 +57,178 @@ func (c *cmdHandlerType) reply(ctx context.Context, text string) (replyMsg *mode
 	return sendReplyToMessage(ctx, c.cmdMsg, text)
 }
 
-func (c *cmdHandlerType) ImagenResultProcess(ctx context.Context, res *openai.ImagesResponse, argsPresent []string, n int, prompt, size, background, quality string) {
+func decodeImagesResponse(res *ImagesResponseType) (imgs [][]byte, err error) {
+	for _, d := range res.Data {
+		imgBytes, err := base64.StdEncoding.DecodeString(d.B64JSON)
+		if err != nil {
+			return nil, err
+		}
+		imgs = append(imgs, imgBytes)
+	}
+	if len(imgs) == 0 {
+		return nil, fmt.Errorf("no images in response")
+	}
+	return
+}
+
+func (c *cmdHandlerType) ImagenResultProcess(ctx context.Context, res *ImagesResponseType, args imagenArgsType) {
 	// Decode base64 image data to bytes
-	imgBytes, err := base64.StdEncoding.DecodeString(res.Data[0].B64JSON)
+	imgs, err := decodeImagesResponse(res)
 	if err != nil {
 		fmt.Println("    base64 decode error:", err)
 		_, _ = c.reply(ctx, errorStr+": "+err.Error())
 		return
 	}
 
-	// Create a slice of byte slices as required by uploadImages
-	imgs := [][]byte{imgBytes}
+	if args.Exact != "" {
+		for i := range imgs {
+			if imgs[i], err = fitToExact(imgs[i], args.Exact); err != nil {
+				fmt.Println("    crop/resize error:", err)
+				_, _ = c.reply(ctx, errorStr+": "+err.Error())
+				return
+			}
+		}
+	}
+
+	genID := newGenerationID()
+	if imgs, err = addWatermarks(imgs, c.cmdMsg.Chat.ID, genID); err != nil {
+		fmt.Println("    watermark error:", err)
+		_, _ = c.reply(ctx, errorStr+": "+err.Error())
+		return
+	}
+
+	imgs = addImagesMetadata(imgs, args, genID)
+
+	if args.RemoveBg {
+		for _, img := range imgs {
+			if !hasTransparency(img) {
+				fmt.Println("    result has no transparency")
+				_, _ = c.reply(ctx, errorStr+": the background couldn't be removed, please try again")
+				return
+			}
+		}
+	}
 
 	// Create a description for the image
-	description := "💭 " + prompt
-	if len(argsPresent) > 0 {
+	description := "💭 " + args.Prompt
+	if args.Variant != "" {
+		description = "🔀 Variant " + args.Variant + "\n" + description
+	}
+	if args.RemoveBg {
+		description = "✂️ Background removed"
+	} else if len(args.ArgsPresent) > 0 {
 		argsDesc := ""
-		for _, arg := range argsPresent {
+		for _, arg := range args.ArgsPresent {
 			if argsDesc != "" {
 				argsDesc += " "
 			}
 
 			switch arg {
+			case "model":
+				argsDesc += "Model: " + args.Model
 			case "size":
+				// Showing the effective size, which can differ from the requested one.
+				size := getImageSize(imgs[0])
+				if size == "" {
+					size = args.Size
+				}
 				argsDesc += "Size: " + size
 			case "background":
-				argsDesc += "Background: " + background
+				argsDesc += "Background: " + args.Background
 			case "quality":
-				argsDesc += "Quality: " + quality
+				argsDesc += "Quality: " + args.Quality
+			case "style":
+				argsDesc += "Style: " + args.Style
+			case "preset":
+				argsDesc += "Preset: " + args.Preset
+			case "upscale":
+				argsDesc += fmt.Sprintf("Upscale: %dx", args.Upscale)
 			}
 		}
 		description += "\n🖼️ " + argsDesc
 	}
 
-	fmt.Println("    uploading images...")
-	_, err = uploadImages(ctx, c.cmdMsg, description, imgs)
-	if err != nil {
-		fmt.Println("    upload error:", err)
-		_, _ = c.reply(ctx, errorStr+": "+err.Error())
-		return
+	// Usage is only returned by token priced models, other models have a fixed price.
+	if res.Usage.OutputTokens > 0 {
+		description += "\n💰 Cost: " + formatCost(res.Cost())
+		if args.EstimatedCost > 0 {
+			description += " (estimated " + formatCost(args.EstimatedCost) + ")"
+		}
+	} else if cost, ok := estimateImagesCost(args, 0); ok {
+		description += "\n💰 Cost: " + formatCost(cost)
+	}
+
+	var msgs []*models.Message
+	var historyFileIDs []string
+	if args.Grid && len(imgs) > 1 {
+		fmt.Println("    uploading grid...")
+		gridMsg, fileIDs, err := c.sendGrid(ctx, description, imgs)
+		if err != nil {
+			fmt.Println("    grid error:", err)
+			_, _ = c.reply(ctx, errorStr+": "+err.Error())
+			return
+		}
+		if !params.GridWithAlbum {
+			msgs = []*models.Message{gridMsg}
+			historyFileIDs = fileIDs
+		}
+	}
+
+	if len(msgs) == 0 {
+		asPhotos := false
+		if args.Upscale > 0 {
+			typingHandler.ChangeTypingStatus(c.cmdMsg.Chat.ID, c.cmdMsg.ID, true)
+			imgs, err = upscaleImages(ctx, imgs, args.Upscale, args.Sharpen)
+			typingHandler.ChangeTypingStatus(c.cmdMsg.Chat.ID, c.cmdMsg.ID, false)
+			if err != nil {
+				fmt.Println("    upscale error:", err)
+				_, _ = c.reply(ctx, errorStr+": "+err.Error())
+				return
+			}
+			imgs = addImagesMetadata(imgs, args, genID)
+
+			fmt.Println("    uploading upscaled images...")
+			msgs, err = uploadDocuments(ctx, c.cmdMsg, description, imgs)
+		} else if args.RemoveBg {
+			// Sending as a document, as Telegram would convert photos to JPEG, losing the alpha channel.
+			fmt.Println("    uploading images as documents...")
+			msgs, err = uploadDocuments(ctx, c.cmdMsg, description, imgs)
+		} else {
+			fmt.Println("    uploading images...")
+			msgs, err = uploadImages(ctx, c.cmdMsg, description, imgs)
+			asPhotos = true
+		}
+		if err != nil {
+			fmt.Println("    upload error:", err)
+			_, _ = c.reply(ctx, errorStr+": "+err.Error())
+			return
+		}
+
+		// Telegram removes the metadata from photos.
+		if asPhotos && slices.Contains(params.SendOriginalsChatIDs, c.cmdMsg.Chat.ID) {
+			fmt.Println("    uploading originals as documents...")
+			if _, err := uploadDocuments(ctx, c.cmdMsg, "📎 Originals with metadata", imgs); err != nil {
+				fmt.Println("    upload error:", err)
+			}
+		}
 	}
 	fmt.Println("    images uploaded successfully")
+
+	archiveResults(ctx, c.cmdMsg.From, &c.cmdMsg.Chat, description, msgs)
+
+	// The individual images of the grid are stored as documents.
+	entry := historyEntryType{
+		Time:      time.Now(),
+		UserID:    c.cmdMsg.From.ID,
+		ChatID:    c.cmdMsg.Chat.ID,
+		Prompt:    args.Prompt,
+		FileIDs:   historyFileIDs,
+		Documents: historyFileIDs != nil,
+	}
+	if entry.FileIDs == nil {
+		entry.FileIDs = getPhotoFileIDs(msgs)
+	}
+	history.Add(entry)
 }
 
 var quoteEscaper = strings.NewReplacer("\\", "\\\\", `"`, "\\\"")
@@ -85,15 +237,21 @@ func escapeQuotes(s string) string {
 	return quoteEscaper.Replace(s)
 }
 
-func (c *cmdHandlerType) createMultipartBody(imgs []ImageFilesDataType, argsPresent []string, n int, prompt, size, background, quality string) (body []byte, contentType string, err error) {
+func (c *cmdHandlerType) createMultipartBody(imgs []ImageFilesDataType, args imagenArgsType, m *imageModelType) (body []byte, contentType string, err error) {
 	// Create multipart writer
 	var b strings.Builder
 	w := multipart.NewWriter(&b)
 
+	// Models which can only edit one image expect it in the image field.
+	imageFieldName := "image[]"
+	if m.MaxEditImages == 1 {
+		imageFieldName = "image"
+	}
+
 	// Add images
 	for _, img := range imgs {
 		h := make(textproto.MIMEHeader)
-		h.Set("Content-Disposition", fmt.Sprintf(`form-data; name="image[]"; filename="%s"`, escapeQuotes(img.Filename)))
+		h.Set("Content-Disposition", fmt.Sprintf(`form-data; name="%s"; filename="%s"`, imageFieldName, escapeQuotes(img.Filename)))
 		h.Set("Content-Type", img.MimeType)
 		imgPart, err := w.CreatePart(h)
 		if err != nil {
@@ -105,12 +263,27 @@ func (c *cmdHandlerType) createMultipartBody(imgs []ImageFilesDataType, argsPres
 		}
 	}
 
+	if len(args.Mask) > 0 {
+		// Add mask
+		h := make(textproto.MIMEHeader)
+		h.Set("Content-Disposition", `form-data; name="mask"; filename="mask.png"`)
+		h.Set("Content-Type", "image/png")
+		maskPart, err := w.CreatePart(h)
+		if err != nil {
+			return nil, "", err
+		}
+		_, err = maskPart.Write(args.Mask)
+		if err != nil {
+			return nil, "", err
+		}
+	}
+
 	// Add prompt
 	promptPart, err := w.CreateFormField("prompt")
 	if err != nil {
 		return nil, "", err
 	}
-	_, err = promptPart.Write([]byte(prompt))
+	_, err = promptPart.Write([]byte(args.Prompt))
 	if err != nil {
 		return nil, "", err
 	}
@@ -120,64 +293,78 @@ func (c *cmdHandlerType) createMultipartBody(imgs []ImageFilesDataType, argsPres
 	if err != nil {
 		return nil, "", err
 	}
-	_, err = modelPart.Write([]byte("gpt-image-1"))
+	_, err = modelPart.Write([]byte(m.Name))
 	if err != nil {
 		return nil, "", err
 	}
 
-	// Add moderation
-	moderationPart, err := w.CreateFormField("moderation")
-	if err != nil {
-		return nil, "", err
+	if m.Moderation {
+		// Add moderation
+		moderationPart, err := w.CreateFormField("moderation")
+		if err != nil {
+			return nil, "", err
+		}
+		_, err = moderationPart.Write([]byte(getModerationLevel(c.cmdMsg.Chat.ID)))
+		if err != nil {
+			return nil, "", err
+		}
 	}
-	_, err = moderationPart.Write([]byte("low"))
-	if err != nil {
-		return nil, "", err
+
+	if m.B64Response {
+		// Add response format
+		responseFormatPart, err := w.CreateFormField("response_format")
+		if err != nil {
+			return nil, "", err
+		}
+		_, err = responseFormatPart.Write([]byte(m.getResponseFormat()))
+		if err != nil {
+			return nil, "", err
+		}
 	}
 
-	if slices.Contains(argsPresent, "n") {
+	if slices.Contains(args.ArgsPresent, "n") {
 		// Add n
 		nPart, err := w.CreateFormField("n")
 		if err != nil {
 			return nil, "", err
 		}
-		_, err = nPart.Write([]byte(strconv.FormatInt(int64(n), 10)))
+		_, err = nPart.Write([]byte(strconv.FormatInt(int64(args.N), 10)))
 		if err != nil {
 			return nil, "", err
 		}
 	}
 
-	if slices.Contains(argsPresent, "size") {
+	if slices.Contains(args.ArgsPresent, "size") {
 		// Add size
 		sizePart, err := w.CreateFormField("size")
 		if err != nil {
 			return nil, "", err
 		}
-		_, err = sizePart.Write([]byte(size))
+		_, err = sizePart.Write([]byte(args.Size))
 		if err != nil {
 			return nil, "", err
 		}
 	}
 
-	if slices.Contains(argsPresent, "quality") {
+	if slices.Contains(args.ArgsPresent, "quality") {
 		// Add quality
 		qualityPart, err := w.CreateFormField("quality")
 		if err != nil {
 			return nil, "", err
 		}
-		_, err = qualityPart.Write([]byte(quality))
+		_, err = qualityPart.Write([]byte(args.Quality))
 		if err != nil {
 			return nil, "", err
 		}
 	}
 
-	if slices.Contains(argsPresent, "background") {
+	if slices.Contains(args.ArgsPresent, "background") {
 		// Add background
 		bgPart, err := w.CreateFormField("background")
 		if err != nil {
 			return nil, "", err
 		}
-		_, err = bgPart.Write([]byte(background))
+		_, err = bgPart.Write([]byte(args.Background))
 		if err != nil {
 			return nil, "", err
 		}
@@ -188,7 +375,9 @@ func (c *cmdHandlerType) createMultipartBody(imgs []ImageFilesDataType, argsPres
 	return []byte(b.String()), w.FormDataContentType(), nil
 }
 
-func (c *cmdHandlerType) ImagenEdit(ctx context.Context, argsPresent []string, n int, prompt, size, background, quality string) {
+// waitForImages returns the images posted by the user (or found in the replied message). If waiting gets
+// canceled, no images and no error is returned.
+func (c *cmdHandlerType) waitForImages(ctx context.Context) (imgs []ImageFilesDataType, err error) {
 	c.expectImageChan = make(chan ImageFilesDataType)
 
 	if c.cmdMsg.ReplyToMessage != nil && (c.cmdMsg.ReplyToMessage.Document != nil || len(c.cmdMsg.ReplyToMessage.Photo) > 0) {
@@ -200,8 +389,6 @@ func (c *cmdHandlerType) ImagenEdit(ctx context.Context, argsPresent []string, n
 		_, _ = c.reply(ctx, "🩻 Please post the image file(s) to process.")
 	}
 
-	var err error
-	var imgs []ImageFilesDataType
 	select {
 	case img := <-c.expectImageChan:
 		if len(img.Data) == 0 {
@@ -225,11 +412,36 @@ func (c *cmdHandlerType) ImagenEdit(ctx context.Context, argsPresent []string, n
 		}
 	case <-ctx.Done():
 		err = fmt.Errorf("context done")
+	case <-jobTracker.Stopping():
+		err = fmt.Errorf("the bot is restarting, please try again later")
 	case <-time.NewTimer(3 * time.Minute).C:
 		err = fmt.Errorf("waiting for image data timeout")
 	}
 	close(c.expectImageChan)
 	c.expectImageChan = nil
+	return
+}
+
+func (c *cmdHandlerType) downloadImageURLs(ctx context.Context, imageURLs []string) (imgs []ImageFilesDataType, err error) {
+	for _, u := range imageURLs {
+		fmt.Println("    downloading", u)
+		img, err := downloadImageURL(ctx, u)
+		if err != nil {
+			return nil, err
+		}
+		imgs = append(imgs, img)
+	}
+	return
+}
+
+func (c *cmdHandlerType) ImagenEdit(ctx context.Context, imageURLs []string, args imagenArgsType) {
+	var imgs []ImageFilesDataType
+	var err error
+	if len(imageURLs) > 0 {
+		imgs, err = c.downloadImageURLs(ctx, imageURLs)
+	} else {
+		imgs, err = c.waitForImages(ctx)
+	}
 
 	if err == nil && len(imgs) == 0 {
 		fmt.Println("    canceled")
@@ -244,9 +456,62 @@ func (c *cmdHandlerType) ImagenEdit(ctx context.Context, argsPresent []string, n
 
 	fmt.Println("    got", len(imgs), "images")
 
+	c.confirmCost(ctx, args, len(imgs), func(ctx context.Context, c *cmdHandlerType, args imagenArgsType) {
+		c.ImagenEditImages(ctx, imgs, args)
+	})
+}
+
+// confirmCost runs fn right away if the estimated cost of the request is below the configured threshold,
+// otherwise only after the requester confirmed the estimated cost. The request is counted by the rate
+// limiter when fn is run.
+func (c *cmdHandlerType) confirmCost(ctx context.Context, args imagenArgsType, inputImages int,
+	fn func(ctx context.Context, c *cmdHandlerType, args imagenArgsType)) {
+
+	cost, ok := estimateImagesCost(args, inputImages)
+	if params.ConfirmCostThreshold == 0 || !ok || cost <= params.ConfirmCostThreshold {
+		if checkRateLimit(ctx, c.cmdMsg, args.N) {
+			fn(ctx, c, args)
+		}
+		return
+	}
+
+	fmt.Println("    asking for cost confirmation, estimated cost:", formatCost(cost))
+	args.EstimatedCost = cost
+	m, _ := getImageModel(args.Model)
+	text := fmt.Sprintf("💰 Estimated cost: %s\n🖼️ Model: %s, images: %d, size: %s", formatCost(cost), m.Name, args.N, args.Size)
+	if q := m.supported(m.Qualities, args.Quality); q != "" {
+		text += ", quality: " + q
+	}
+	if inputImages > 0 {
+		text += fmt.Sprintf(", input images: %d", inputImages)
+	}
+	c.confirm(ctx, text, "✅ Confirm ("+formatCost(cost)+")", func(ctx context.Context, c *cmdHandlerType) {
+		if checkRateLimit(ctx, c.cmdMsg, args.N) {
+			fn(ctx, c, args)
+		}
+	})
+}
+
+func (c *cmdHandlerType) ImagenEditImages(ctx context.Context, imgs []ImageFilesDataType, args imagenArgsType) {
+	m, err := getImageModel(args.Model)
+	if err == nil {
+		err = m.ValidateEditImages(len(imgs))
+	}
+	if err == nil && m.SquarePNGInput {
+		imgs, args.Mask, err = convertToSquarePNGs(imgs, args.Mask)
+	}
+	if err != nil {
+		fmt.Println("    error:", err)
+		_, _ = c.reply(ctx, errorStr+": "+err.Error())
+		return
+	}
+
+	jobID := journal.Add(c.cmdMsg, args, imgs)
+	defer journal.Finish(ctx, jobID)
+
 	typingHandler.ChangeTypingStatus(c.cmdMsg.Chat.ID, c.cmdMsg.ID, true)
 
-	body, contentType, err := c.createMultipartBody(imgs, argsPresent, n, prompt, size, background, quality)
+	body, contentType, err := c.createMultipartBody(imgs, args, m)
 	if err != nil {
 		fmt.Println("    create multipart body error:", err)
 		_, _ = c.reply(ctx, errorStr+": "+err.Error())
@@ -254,8 +519,8 @@ func (c *cmdHandlerType) ImagenEdit(ctx context.Context, argsPresent []string, n
 	}
 
 	fmt.Println("    sending edit request...")
-	var res openai.ImagesResponse
-	err = apiClient.Post(ctx, "images/edits", body, &res, option.WithHeader("Content-Type", contentType))
+	var res ImagesResponseType
+	err = apiClient.Post(ctx, "images/edits", m.Name, body, &res, option.WithHeader("Content-Type", contentType))
 
 	typingHandler.ChangeTypingStatus(c.cmdMsg.Chat.ID, c.cmdMsg.ID, false)
 
@@ -265,41 +530,72 @@ func (c *cmdHandlerType) ImagenEdit(ctx context.Context, argsPresent []string, n
 		return
 	}
 
-	c.ImagenResultProcess(ctx, &res, argsPresent, n, prompt, size, background, quality)
+	c.ImagenResultProcess(ctx, &res, args)
 }
 
 type ImageGenerateParams struct {
-	Prompt     string `json:"prompt"`
-	N          int64  `json:"n,omitzero"`
-	Model      string `json:"model,omitzero"`
-	Size       string `json:"size,omitzero"`
-	Quality    string `json:"quality,omitzero"`
-	Background string `json:"background,omitzero"`
-	Moderation string `json:"moderation,omitzero"`
+	Prompt         string `json:"prompt"`
+	N              int64  `json:"n,omitzero"`
+	Model          string `json:"model,omitzero"`
+	Size           string `json:"size,omitzero"`
+	Quality        string `json:"quality,omitzero"`
+	Background     string `json:"background,omitzero"`
+	Style          string `json:"style,omitzero"`
+	Moderation     string `json:"moderation,omitzero"`
+	ResponseFormat string `json:"response_format,omitzero"`
 }
 
-func (c *cmdHandlerType) ImagenGenerate(ctx context.Context, argsPresent []string, n int, prompt, size, background, quality string) {
-	typingHandler.ChangeTypingStatus(c.cmdMsg.Chat.ID, c.cmdMsg.ID, true)
+type ImagesResponseType struct {
+	Data []struct {
+		B64JSON string `json:"b64_json"`
+	} `json:"data"`
+	Usage struct {
+		InputTokens        int `json:"input_tokens"`
+		OutputTokens       int `json:"output_tokens"`
+		InputTokensDetails struct {
+			TextTokens  int `json:"text_tokens"`
+			ImageTokens int `json:"image_tokens"`
+		} `json:"input_tokens_details"`
+	} `json:"usage"`
+}
 
+func imagenGenerateRequest(ctx context.Context, args imagenArgsType, moderation string) (res ImagesResponseType, err error) {
+	m, err := getImageModel(args.Model)
+	if err != nil {
+		return res, err
+	}
+
+	// Default values which are not supported by the model are omitted.
 	parms := ImageGenerateParams{
-		Prompt:     prompt,
-		N:          int64(n),
-		Model:      "gpt-image-1",
-		Size:       size,
-		Quality:    quality,
-		Background: background,
-		Moderation: "low",
+		Prompt:         args.Prompt,
+		N:              int64(args.N),
+		Model:          m.Name,
+		Size:           m.supported(m.Sizes, args.Size),
+		Quality:        m.supported(m.Qualities, args.Quality),
+		Background:     m.supported(m.Backgrounds, args.Background),
+		Style:          m.supported(m.Styles, args.Style),
+		ResponseFormat: m.getResponseFormat(),
+	}
+	if m.Moderation {
+		parms.Moderation = moderation
 	}
 	body, err := json.Marshal(parms)
 	if err != nil {
-		fmt.Println("    json marshal error:", err)
-		_, _ = c.reply(ctx, errorStr+": "+err.Error())
-		return
+		return res, err
 	}
 
+	err = apiClient.Post(ctx, "images/generations", m.Name, body, &res, option.WithHeader("Content-Type", "application/json"))
+	return
+}
+
+func (c *cmdHandlerType) ImagenGenerate(ctx context.Context, args imagenArgsType) {
+	jobID := journal.Add(c.cmdMsg, args, nil)
+	defer journal.Finish(ctx, jobID)
+
+	typingHandler.ChangeTypingStatus(c.cmdMsg.Chat.ID, c.cmdMsg.ID, true)
+
 	fmt.Println("    sending generate request...")
-	var res openai.ImagesResponse
-	err = apiClient.Post(ctx, "images/generations", body, &res, option.WithHeader("Content-Type", "application/json"))
+	res, err := imagenGenerateRequest(ctx, args, getModerationLevel(c.cmdMsg.Chat.ID))
 
 	typingHandler.ChangeTypingStatus(c.cmdMsg.Chat.ID, c.cmdMsg.ID, false)
 
@@ -309,7 +605,7 @@ func (c *cmdHandlerType) ImagenGenerate(ctx context.Context, argsPresent []strin
 		return
 	}
 
-	c.ImagenResultProcess(ctx, &res, argsPresent, n, prompt, size, background, quality)
+	c.ImagenResultProcess(ctx, &res, args)
 }
 
 func (c *cmdHandlerType) Imagen(ctx context.Context) {
@@ -320,10 +616,20 @@ func (c *cmdHandlerType) Imagen(ctx context.Context) {
 	size := string(openai.ImageEditParamsSize1024x1024)
 	background := "opaque"
 	quality := "auto"
+	var model, style, aspectRatio string
+	exact := false
+	upscale := 0
+	sharpen := false
+	grid := false
 	promptParts := []string{}
+	var imageURLs []string
 
 	// Split text into words
 	words := strings.Fields(c.cmdMsg.Text)
+	words, presetName, preset := applyStylePresetFlags(words, c.cmdMsg.Chat.ID, c.cmdMsg.From.ID)
+	if preset != nil {
+		argsPresent = append(argsPresent, "preset")
+	}
 	i := 0
 
 	// Parse arguments
@@ -336,14 +642,34 @@ func (c *cmdHandlerType) Imagen(ctx context.Context) {
 			switch argName {
 			case "edit":
 				isEdit = true
-			case "n", "size", "background", "quality":
+			case "square", "portrait", "landscape":
+				ar := orientationShorthands[argName]
+				aspectRatio = fmt.Sprint(ar[0], ":", ar[1])
+			case "exact":
+				exact = true
+			case "sharpen":
+				sharpen = true
+			case "grid":
+				grid = true
+			case "ar":
+				if i+1 >= len(words) || strings.HasPrefix(words[i+1], "-") {
+					fmt.Println("	Missing value for flag:", argName)
+					_, _ = c.reply(ctx, errorStr+": Missing value for flag: "+argName)
+					return
+				}
+				aspectRatio = words[i+1]
+				i++
+			case "n", "model", "size", "background", "quality", "style", "upscale":
 				if i+1 >= len(words) || strings.HasPrefix(words[i+1], "-") {
 					fmt.Println("	Missing value for flag:", argName)
 					_, _ = c.reply(ctx, errorStr+": Missing value for flag: "+argName)
 					return
 				}
 
-				argsPresent = append(argsPresent, argName)
+				// Flags set by a style preset can be overridden.
+				if !slices.Contains(argsPresent, argName) {
+					argsPresent = append(argsPresent, argName)
+				}
 
 				value := words[i+1]
 				i++ // Skip the next word as we've processed it
@@ -357,12 +683,24 @@ func (c *cmdHandlerType) Imagen(ctx context.Context) {
 						_, _ = c.reply(ctx, errorStr+": Invalid value for n: "+value)
 						return
 					}
+				case "model":
+					model = value
 				case "size":
 					size = value
 				case "background":
 					background = value
 				case "quality":
 					quality = value
+				case "style":
+					style = value
+				case "upscale":
+					var err error
+					upscale, err = parseUpscaleFactor(value)
+					if err != nil {
+						fmt.Println("	Invalid value for upscale:", value)
+						_, _ = c.reply(ctx, errorStr+": "+err.Error())
+						return
+					}
 				}
 			}
 		} else {
@@ -373,6 +711,31 @@ func (c *cmdHandlerType) Imagen(ctx context.Context) {
 		i++
 	}
 
+	// URLs are only used as input images in edit mode, or if the command replies to a message which is not an
+	// image, otherwise they are kept in the prompt.
+	replyHasImage := c.cmdMsg.ReplyToMessage != nil &&
+		(c.cmdMsg.ReplyToMessage.Document != nil || len(c.cmdMsg.ReplyToMessage.Photo) > 0)
+	if !replyHasImage && (isEdit || c.cmdMsg.ReplyToMessage != nil) {
+		var parts []string
+		for _, word := range promptParts {
+			if isImageURL(word) {
+				imageURLs = append(imageURLs, word)
+			} else {
+				parts = append(parts, word)
+			}
+		}
+		promptParts = parts
+
+		for _, e := range c.cmdMsg.Entities {
+			if e.Type == models.MessageEntityTypeTextLink && isImageURL(e.URL) {
+				imageURLs = append(imageURLs, e.URL)
+			}
+		}
+		if len(imageURLs) > 0 {
+			isEdit = true
+		}
+	}
+
 	// Combine prompt parts into the final prompt
 	prompt := strings.Join(promptParts, " ")
 	prompt = strings.TrimSpace(prompt)
@@ -383,17 +746,100 @@ func (c *cmdHandlerType) Imagen(ctx context.Context) {
 		return
 	}
 
-	if c.cmdMsg.ReplyToMessage != nil && (c.cmdMsg.ReplyToMessage.Document != nil || len(c.cmdMsg.ReplyToMessage.Photo) > 0) {
+	if preset != nil {
+		prompt = preset.apply(prompt)
+	}
+
+	var variants []promptVariantType
+	if count := countPromptVariants(prompt); count > params.PromptMatrixMax {
+		fmt.Println("	Too many prompt variants")
+		_, _ = c.reply(ctx, fmt.Sprintf("%s: Too many prompt variants, max. %d", errorStr, params.PromptMatrixMax))
+		return
+	} else if count > 1 {
+		variants = expandPromptMatrix(prompt)
+	}
+
+	// Screening each variant, as the rejected words can be in any of the options.
+	prompts := []string{prompt}
+	if len(variants) > 0 {
+		prompts = nil
+		for _, v := range variants {
+			prompts = append(prompts, v.Prompt)
+		}
+	}
+	for _, p := range prompts {
+		if reason := moderationHandler.ScreenPrompt(ctx, c.cmdMsg.From.ID, p); reason != "" {
+			fmt.Println("	Prompt rejected:", reason)
+			_, _ = c.reply(ctx, errorStr+": Prompt rejected, "+reason)
+			return
+		}
+	}
+
+	if replyHasImage {
 		isEdit = true
+	} else if c.cmdMsg.ReplyToMessage != nil && isEdit && len(imageURLs) == 0 {
+		imageURLs = getMessageImageURLs(c.cmdMsg.ReplyToMessage)
 	}
 
-	fmt.Println("    parsed args: n:", n, "edit:", isEdit, "size:", size, "background:", background, "quality:", quality, "prompt:", prompt)
+	fmt.Println("    parsed args: n:", n, "edit:", isEdit, "model:", model, "size:", size, "aspect ratio:", aspectRatio, "exact:", exact, "upscale:", upscale, "sharpen:", sharpen, "grid:", grid, "background:", background, "quality:", quality, "style:", style, "preset:", presetName, "image urls:", imageURLs, "prompt:", prompt)
+
+	args := imagenArgsType{
+		ArgsPresent: argsPresent,
+		N:           n,
+		Prompt:      prompt,
+		Model:       model,
+		Size:        size,
+		Background:  background,
+		Quality:     quality,
+		Style:       style,
+		Preset:      presetName,
+		Upscale:     upscale,
+		Sharpen:     sharpen,
+		Grid:        grid,
+	}
 
+	m, err := getImageModel(model)
+	if err == nil {
+		err = m.resolveSizeShorthands(&args, aspectRatio, exact)
+	}
+	if err == nil && grid && params.InlineStorageChatID == 0 {
+		err = fmt.Errorf(gridNoStorageChatStr)
+	}
+	if err == nil {
+		err = m.Validate(args, isEdit)
+	}
+	for _, v := range variants {
+		if err != nil {
+			break
+		}
+		variantArgs := args
+		variantArgs.Prompt = v.Prompt
+		err = m.Validate(variantArgs, isEdit)
+	}
+	if err != nil {
+		fmt.Println("	Invalid args:", err)
+		_, _ = c.reply(ctx, errorStr+": "+err.Error())
+		return
+	}
+
+	// Checked here, so generations started by buttons (with the presser as the sender) are limited too, and
+	// the images of the expanded presets and prompt matrix variants are counted. The request is only counted
+	// when it's confirmed (see confirmCost and ImagenMatrix), this just rejects it early.
+	if !precheckRateLimit(ctx, c.cmdMsg, args.N*max(1, len(variants))) {
+		return
+	}
+
+	if len(variants) > 0 {
+		c.ImagenMatrix(ctx, isEdit, imageURLs, args, variants)
+		return
+	}
 	if isEdit {
-		c.ImagenEdit(ctx, argsPresent, n, prompt, size, background, quality)
+		c.ImagenEdit(ctx, imageURLs, args)
 		return
 	}
-	c.ImagenGenerate(ctx, argsPresent, n, prompt, size, background, quality)
+	c.confirmCost(ctx, args, 0, func(ctx context.Context, c *cmdHandlerType, args imagenArgsType) {
+		c.ImagenGenerate(ctx, args)
+	})
 }
 
 func (c *cmdHandlerType) Cancel(ctx context.Context) {
@@ -425,12 +871,32 @@ func (c *cmdHandlerType) Help(ctx context.Context, cmdChar string) {
 		"Available commands:\n\n"+
 		cmdChar+"imagen (args) [prompt]\n"+
 		"  args can be:\n"+
-		"    -edit: toggles edit mode (auto enabled if you reply to an image)\n"+
+		"    -edit: toggles edit mode (auto enabled if you reply to an image, or reply to a message and add image URLs to the prompt)\n"+
 		"    -n 1: generate n output images\n"+
-		"    -size 1024x1024\n"+
+		"    -model "+params.ImageModel+" (available: "+strings.Join(getImageModelNames(), ", ")+")\n"+
+		"    -size 1024x1024 (or 720p, 1080p, 2k, 4k)\n"+
+		"    -ar 16:9, -square, -portrait, -landscape: use the nearest supported size with the given aspect ratio\n"+
+		"    -exact: crop/resize the output to the exact aspect ratio or size requested\n"+
+		"    -upscale 2x: upscale the output locally and send it as a document (-sharpen also sharpens it)\n"+
+		"    -grid: send multiple output images as one numbered grid image with pick and edit buttons\n"+
 		"    -background transparent (default is opaque)\n"+
 		"    -quality auto\n"+
+		"    -style vivid (dall-e-3 only), or the name of a style preset\n"+
+		"  prompt can contain wildcards like {red|green|blue} to generate all combinations\n"+
 		cmdChar+"imagencancel - cancel waiting for images\n\n"+
+		cmdChar+"imagendescribe - describe the replied image and suggest a prompt for it\n\n"+
+		cmdChar+"imagenextend (-left 256) (-right 256) (-top 256) (-bottom 256) (-ar 16:9) (prompt) - extend the replied image beyond its borders\n\n"+
+		cmdChar+"imagennobg (-model name) - remove the background of the replied image, the result is sent as a PNG document\n\n"+
+		cmdChar+"imagencrop [x,y,w,h|-ar 16:9] - crop the replied image\n"+
+		cmdChar+"imagenrotate [90|180|270] - rotate the replied image clockwise\n"+
+		cmdChar+"imagenflip (h|v) - flip the replied image\n"+
+		cmdChar+"imagenresize [512|512x384] - resize the replied image\n"+
+		cmdChar+"imagenconvert [png|jpeg|webp|gif|bmp|tiff] - convert the replied image\n\n"+
+		cmdChar+"imagenupscale (2x|3x|4x) (-sharpen) - upscale the replied image and send it as a document\n\n"+
+		cmdChar+"imageninfo - show the generation info and invisible watermark of the replied image file, and re-run the generation\n\n"+
+		cmdChar+"imagenstyle [list|add name (flags) \"template\"|remove name] - manage your own (in private chat) or the group's style presets (group admins only)\n\n"+
+		cmdChar+"imagenkey [key|remove] - set or remove your own API key (in private chat) or the group's API key (group admins only)\n\n"+
+		cmdChar+"imagenkeys - show the API key health (admins only)\n\n"+
 		cmdChar+"imagenhelp - show this help\n\n"+
 		"For more information see https://github.com/nonoo/imagen-telegram-bot and https://platform.openai.com/docs/guides/image-generation")
 }
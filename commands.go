@@ -0,0 +1,211 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"sort"
+
+	"github.com/go-telegram/bot"
+	"github.com/go-telegram/bot/models"
+)
+
+type botCommandType struct {
+	command      string
+	descriptions map[string]string // map[LanguageCode]Description, "" is the default language.
+	adminOnly    bool
+}
+
+var botCommands = []botCommandType{
+	{
+		command: "imagen",
+		descriptions: map[string]string{
+			"":   "Generate or edit images",
+			"hu": "Képek generálása vagy szerkesztése",
+		},
+	},
+	{
+		command: "imagencancel",
+		descriptions: map[string]string{
+			"":   "Cancel waiting for images",
+			"hu": "Képekre várakozás megszakítása",
+		},
+	},
+	{
+		command: "imagendescribe",
+		descriptions: map[string]string{
+			"":   "Describe an image and suggest a prompt for it",
+			"hu": "Kép leírása és prompt javaslat hozzá",
+		},
+	},
+	{
+		command: "imagenextend",
+		descriptions: map[string]string{
+			"":   "Extend an image beyond its borders",
+			"hu": "Kép kiterjesztése a szélein túl",
+		},
+	},
+	{
+		command: "imagennobg",
+		descriptions: map[string]string{
+			"":   "Remove the background of an image",
+			"hu": "Kép hátterének eltávolítása",
+		},
+	},
+	{
+		command: "imagencrop",
+		descriptions: map[string]string{
+			"":   "Crop an image",
+			"hu": "Kép vágása",
+		},
+	},
+	{
+		command: "imagenrotate",
+		descriptions: map[string]string{
+			"":   "Rotate an image",
+			"hu": "Kép forgatása",
+		},
+	},
+	{
+		command: "imagenflip",
+		descriptions: map[string]string{
+			"":   "Flip an image",
+			"hu": "Kép tükrözése",
+		},
+	},
+	{
+		command: "imagenresize",
+		descriptions: map[string]string{
+			"":   "Resize an image",
+			"hu": "Kép átméretezése",
+		},
+	},
+	{
+		command: "imagenconvert",
+		descriptions: map[string]string{
+			"":   "Convert an image to another format",
+			"hu": "Kép konvertálása más formátumba",
+		},
+	},
+	{
+		command: "imagenupscale",
+		descriptions: map[string]string{
+			"":   "Upscale an image",
+			"hu": "Kép felskálázása",
+		},
+	},
+	{
+		command: "imageninfo",
+		descriptions: map[string]string{
+			"":   "Show the generation info of an image",
+			"hu": "Kép generálási adatainak megjelenítése",
+		},
+	},
+	{
+		command: "imagenstyle",
+		descriptions: map[string]string{
+			"":   "Manage style presets",
+			"hu": "Stílus sablonok kezelése",
+		},
+	},
+	{
+		command: "imagenkey",
+		descriptions: map[string]string{
+			"":   "Set your own or the group's API key",
+			"hu": "Saját vagy a csoport API kulcsának beállítása",
+		},
+	},
+	{
+		command: "imagenkeys",
+		descriptions: map[string]string{
+			"":   "Show the API key health",
+			"hu": "API kulcsok állapotának megjelenítése",
+		},
+		adminOnly: true,
+	},
+	{
+		command: "imagenhelp",
+		descriptions: map[string]string{
+			"":   "Show the help",
+			"hu": "Súgó megjelenítése",
+		},
+	},
+}
+
+// getBotCommandLanguages returns all language codes which have at least one command description.
+func getBotCommandLanguages() (langs []string) {
+	m := make(map[string]bool)
+	for _, c := range botCommands {
+		for lang := range c.descriptions {
+			m[lang] = true
+		}
+	}
+	for lang := range m {
+		langs = append(langs, lang)
+	}
+	sort.Strings(langs)
+	return
+}
+
+func getBotCommands(lang string, includeAdminOnly bool) (cmds []models.BotCommand) {
+	for _, c := range botCommands {
+		if c.adminOnly && !includeAdminOnly {
+			continue
+		}
+		desc, ok := c.descriptions[lang]
+		if !ok {
+			desc = c.descriptions[""]
+		}
+		cmds = append(cmds, models.BotCommand{
+			Command:     c.command,
+			Description: desc,
+		})
+	}
+	return
+}
+
+func setBotCommands(ctx context.Context, scope models.BotCommandScope, lang string, includeAdminOnly bool) error {
+	_, err := telegramBot.SetMyCommands(ctx, &bot.SetMyCommandsParams{
+		Commands:     getBotCommands(lang, includeAdminOnly),
+		Scope:        scope,
+		LanguageCode: lang,
+	})
+	return err
+}
+
+// registerBotCommands registers the command list and the bot descriptions with Telegram.
+func registerBotCommands(ctx context.Context) {
+	fmt.Println("registering bot commands...")
+
+	for _, lang := range getBotCommandLanguages() {
+		if err := setBotCommands(ctx, &models.BotCommandScopeAllPrivateChats{}, lang, false); err != nil {
+			fmt.Println("  can't set private chat commands for language \""+lang+"\":", err)
+		}
+		if err := setBotCommands(ctx, &models.BotCommandScopeAllGroupChats{}, lang, false); err != nil {
+			fmt.Println("  can't set group chat commands for language \""+lang+"\":", err)
+		}
+		// Admin only commands are only visible in the private chats of the admins.
+		for _, adminID := range params.AdminUserIDs {
+			if err := setBotCommands(ctx, &models.BotCommandScopeChat{ChatID: adminID}, lang, true); err != nil {
+				fmt.Println("  can't set admin commands for language \""+lang+"\" and user", adminID, "error:", err)
+			}
+		}
+	}
+
+	if params.BotDescription != "" {
+		_, err := telegramBot.SetMyDescription(ctx, &bot.SetMyDescriptionParams{
+			Description: params.BotDescription,
+		})
+		if err != nil {
+			fmt.Println("  can't set bot description:", err)
+		}
+	}
+
+	if params.BotShortDescription != "" {
+		_, err := telegramBot.SetMyShortDescription(ctx, &bot.SetMyShortDescriptionParams{
+			ShortDescription: params.BotShortDescription,
+		})
+		if err != nil {
+			fmt.Println("  can't set bot short description:", err)
+		}
+	}
+}
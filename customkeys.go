@@ -0,0 +1,277 @@
+package main
+
+import (
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/go-telegram/bot"
+	"github.com/go-telegram/bot/models"
+	"golang.org/x/exp/slices"
+)
+
+const (
+	customKeyFallbackOperator = "operator" // Operator keys are used if there's no custom key or it fails.
+	customKeyFallbackNone     = "none"     // Operator keys are only used if there's no custom key.
+	customKeyFallbackRequire  = "require"  // Only admins can use the operator keys.
+)
+
+type apiKeyCtxKeyType struct{}
+
+// apiKeyCtxValueType is stored in the request context and tells the API client which key to use.
+type apiKeyCtxValueType struct {
+	customKey      *apiKeyType // Nil if the user/group has no custom key.
+	canUseOperator bool
+}
+
+// Custom keys are registered by group admins for their group, or by users for themselves. They are stored
+// encrypted with the master key.
+type customKeysType struct {
+	mutex    sync.Mutex
+	aead     cipher.AEAD
+	filename string
+	keys     map[string]string // map[Owner]EncryptedKey, owner is "user:ID" or "group:ID"
+}
+
+var customKeys customKeysType
+
+func getCustomKeyOwner(chatID, userID int64) string {
+	if chatID < 0 {
+		return "group:" + strconv.FormatInt(chatID, 10)
+	}
+	return "user:" + strconv.FormatInt(userID, 10)
+}
+
+func (c *customKeysType) Init() error {
+	c.keys = make(map[string]string)
+	if params.KeyEncryptionKey == "" {
+		return nil
+	}
+
+	masterKey := sha256.Sum256([]byte(params.KeyEncryptionKey))
+	block, err := aes.NewCipher(masterKey[:])
+	if err != nil {
+		return err
+	}
+	c.aead, err = cipher.NewGCM(block)
+	if err != nil {
+		return err
+	}
+
+	c.filename = filepath.Join(params.DataDir, "customkeys.json")
+	d, err := os.ReadFile(c.filename)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return fmt.Errorf("can't read custom keys: %w", err)
+	}
+	if err := json.Unmarshal(d, &c.keys); err != nil {
+		return fmt.Errorf("can't parse custom keys: %w", err)
+	}
+	return nil
+}
+
+func (c *customKeysType) isEnabled() bool {
+	return c.aead != nil
+}
+
+// save should be called with the mutex locked.
+func (c *customKeysType) save() error {
+	d, err := json.Marshal(c.keys)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(c.filename), 0700); err != nil {
+		return err
+	}
+	return os.WriteFile(c.filename, d, 0600)
+}
+
+func (c *customKeysType) encrypt(s string) (string, error) {
+	nonce := make([]byte, c.aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return "", err
+	}
+	return base64.StdEncoding.EncodeToString(c.aead.Seal(nonce, nonce, []byte(s), nil)), nil
+}
+
+func (c *customKeysType) decrypt(s string) (string, error) {
+	d, err := base64.StdEncoding.DecodeString(s)
+	if err != nil {
+		return "", err
+	}
+	if len(d) < c.aead.NonceSize() {
+		return "", fmt.Errorf("invalid encrypted key")
+	}
+	plain, err := c.aead.Open(nil, d[:c.aead.NonceSize()], d[c.aead.NonceSize():], nil)
+	if err != nil {
+		return "", err
+	}
+	return string(plain), nil
+}
+
+func (c *customKeysType) Set(owner, key string) error {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	encrypted, err := c.encrypt(key)
+	if err != nil {
+		return err
+	}
+	c.keys[owner] = encrypted
+	return c.save()
+}
+
+func (c *customKeysType) Remove(owner string) error {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	delete(c.keys, owner)
+	return c.save()
+}
+
+// Get returns the custom key of the given owner, or nil if there's none.
+func (c *customKeysType) Get(owner string) *apiKeyType {
+	if !c.isEnabled() {
+		return nil
+	}
+
+	c.mutex.Lock()
+	encrypted, ok := c.keys[owner]
+	c.mutex.Unlock()
+	if !ok {
+		return nil
+	}
+
+	key, err := c.decrypt(encrypted)
+	if err != nil {
+		fmt.Println("  can't decrypt custom key of", owner+":", err)
+		return nil
+	}
+	return &apiKeyType{
+		apiKeyConfigType: apiKeyConfigType{Key: key},
+		client:           newCustomKeyClient(key),
+	}
+}
+
+// WithContext returns a context which tells the API client to use the custom key of the group (if
+// the chat is a group and it has a key) or the user.
+func (c *customKeysType) WithContext(ctx context.Context, chatID, userID int64) context.Context {
+	v := apiKeyCtxValueType{
+		customKey: c.Get(getCustomKeyOwner(chatID, userID)),
+	}
+	if v.customKey == nil && chatID < 0 {
+		v.customKey = c.Get(getCustomKeyOwner(0, userID))
+	}
+	v.canUseOperator = params.CustomKeyFallback != customKeyFallbackRequire || slices.Contains(params.AdminUserIDs, userID)
+	return context.WithValue(ctx, apiKeyCtxKeyType{}, v)
+}
+
+func getAPIKeyCtxValue(ctx context.Context) (v apiKeyCtxValueType, ok bool) {
+	v, ok = ctx.Value(apiKeyCtxKeyType{}).(apiKeyCtxValueType)
+	return
+}
+
+func isChatAdmin(ctx context.Context, chatID, userID int64) bool {
+	if slices.Contains(params.AdminUserIDs, userID) {
+		return true
+	}
+	member, err := telegramBot.GetChatMember(ctx, &bot.GetChatMemberParams{
+		ChatID: chatID,
+		UserID: userID,
+	})
+	if err != nil {
+		fmt.Println("  can't get chat member:", err)
+		return false
+	}
+	return member.Type == models.ChatMemberTypeOwner || member.Type == models.ChatMemberTypeAdministrator
+}
+
+// redactKeyCommand returns the message text with the key of the imagenkey command hidden, so keys don't
+// end up in the logs.
+func redactKeyCommand(text string) string {
+	fields := strings.Fields(text)
+	if len(fields) < 2 || (text[0] != '/' && text[0] != '!') {
+		return text
+	}
+	cmd, _, _ := strings.Cut(fields[0][1:], "@")
+	if cmd != "imagenkey" || fields[1] == "remove" {
+		return text
+	}
+	return fields[0] + " <redacted>"
+}
+
+func (c *cmdHandlerType) Key(ctx context.Context) {
+	if !customKeys.isEnabled() {
+		_, _ = c.reply(ctx, errorStr+": custom API keys are disabled")
+		return
+	}
+
+	arg := strings.TrimSpace(c.cmdMsg.Text)
+	isGroup := c.cmdMsg.Chat.ID < 0
+	owner := getCustomKeyOwner(c.cmdMsg.Chat.ID, c.cmdMsg.From.ID)
+
+	if arg != "" && arg != "remove" {
+		// Deleting the message first so the key doesn't stay visible even if storing fails.
+		_, err := telegramBot.DeleteMessage(ctx, &bot.DeleteMessageParams{
+			ChatID:    c.cmdMsg.Chat.ID,
+			MessageID: c.cmdMsg.ID,
+		})
+		if err != nil {
+			fmt.Println("  can't delete key message:", err)
+			_, _ = sendMessage(ctx, c.cmdMsg.Chat.ID, "⚠️ Can't delete the message containing the key, please delete it manually")
+		}
+	}
+
+	if isGroup && arg != "" && !isChatAdmin(ctx, c.cmdMsg.Chat.ID, c.cmdMsg.From.ID) {
+		fmt.Println("  user is not a group admin")
+		_, _ = sendMessage(ctx, c.cmdMsg.Chat.ID, errorStr+": only group admins can change the group's API key")
+		return
+	}
+
+	switch arg {
+	case "":
+		if k := customKeys.Get(owner); k != nil {
+			_, _ = c.reply(ctx, "🔑 Using custom API key "+k.maskedKey())
+		} else {
+			_, _ = c.reply(ctx, "🔑 No custom API key set")
+		}
+	case "remove":
+		if err := customKeys.Remove(owner); err != nil {
+			fmt.Println("  can't remove custom key:", err)
+			_, _ = c.reply(ctx, errorStr+": "+err.Error())
+			return
+		}
+		fmt.Println("  custom key removed")
+		_, _ = c.reply(ctx, "🔑 Custom API key removed")
+	default:
+		k := &apiKeyType{
+			apiKeyConfigType: apiKeyConfigType{Key: arg},
+			client:           newCustomKeyClient(arg),
+		}
+		var res any
+		if err := k.client.Get(ctx, "models", nil, &res); err != nil {
+			fmt.Println("  custom key check failed:", err)
+			_, _ = sendMessage(ctx, c.cmdMsg.Chat.ID, errorStr+": the API key doesn't work: "+err.Error())
+			return
+		}
+
+		if err := customKeys.Set(owner, arg); err != nil {
+			fmt.Println("  can't store custom key:", err)
+			_, _ = sendMessage(ctx, c.cmdMsg.Chat.ID, errorStr+": "+err.Error())
+			return
+		}
+		fmt.Println("  custom key stored")
+		_, _ = sendMessage(ctx, c.cmdMsg.Chat.ID, "🔑 Custom API key "+k.maskedKey()+" stored")
+	}
+}
@@ -0,0 +1,140 @@
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	"github.com/go-telegram/bot/models"
+	"github.com/openai/openai-go"
+	"github.com/openai/openai-go/option"
+)
+
+const describeSystemPrompt = "You describe images in detail. Reply with a JSON object with two string fields: " +
+	"\"description\" containing a detailed description of the image (subject, composition, style, colors, lighting), " +
+	"and \"prompt\" containing a single paragraph image generation prompt which would recreate the image."
+
+type chatContentPartType struct {
+	Type     string `json:"type"`
+	Text     string `json:"text,omitzero"`
+	ImageURL *struct {
+		URL string `json:"url"`
+	} `json:"image_url,omitempty"`
+}
+
+type chatMessageType struct {
+	Role    string `json:"role"`
+	Content any    `json:"content"`
+}
+
+type ChatCompletionParams struct {
+	Model          string            `json:"model"`
+	Messages       []chatMessageType `json:"messages"`
+	ResponseFormat *struct {
+		Type string `json:"type"`
+	} `json:"response_format,omitempty"`
+}
+
+type imageDescriptionType struct {
+	Description string `json:"description"`
+	Prompt      string `json:"prompt"`
+}
+
+func describeImage(ctx context.Context, img ImageFilesDataType) (desc imageDescriptionType, err error) {
+	imagePart := chatContentPartType{Type: "image_url"}
+	imagePart.ImageURL = &struct {
+		URL string `json:"url"`
+	}{URL: "data:" + img.MimeType + ";base64," + base64.StdEncoding.EncodeToString(img.Data)}
+
+	parms := ChatCompletionParams{
+		Model: params.VisionModel,
+		Messages: []chatMessageType{
+			{Role: "system", Content: describeSystemPrompt},
+			{Role: "user", Content: []chatContentPartType{
+				{Type: "text", Text: "Describe this image."},
+				imagePart,
+			}},
+		},
+		ResponseFormat: &struct {
+			Type string `json:"type"`
+		}{Type: "json_object"},
+	}
+	body, err := json.Marshal(parms)
+	if err != nil {
+		return desc, err
+	}
+
+	var res openai.ChatCompletion
+	err = apiClient.Post(ctx, "chat/completions", params.VisionModel, body, &res, option.WithHeader("Content-Type", "application/json"))
+	if err != nil {
+		return desc, err
+	}
+	if len(res.Choices) == 0 {
+		return desc, fmt.Errorf("no response from model")
+	}
+	if res.Choices[0].Message.Refusal != "" {
+		return desc, fmt.Errorf("model refused: %s", res.Choices[0].Message.Refusal)
+	}
+
+	err = json.Unmarshal([]byte(res.Choices[0].Message.Content), &desc)
+	if err != nil {
+		return desc, fmt.Errorf("can't parse model response: %w", err)
+	}
+	desc.Prompt = strings.TrimSpace(desc.Prompt)
+	if desc.Prompt == "" {
+		return desc, fmt.Errorf("model returned no prompt")
+	}
+	return
+}
+
+func (c *cmdHandlerType) Describe(ctx context.Context) {
+	imgs, err := c.waitForImages(ctx)
+	if err == nil && len(imgs) == 0 {
+		fmt.Println("    canceled")
+		return
+	}
+	if err != nil {
+		fmt.Println("    error:", err)
+		_, _ = c.reply(ctx, errorStr+": "+err.Error())
+		return
+	}
+
+	typingHandler.ChangeTypingStatus(c.cmdMsg.Chat.ID, c.cmdMsg.ID, true)
+
+	fmt.Println("    sending describe request...")
+	desc, err := describeImage(ctx, imgs[0])
+
+	typingHandler.ChangeTypingStatus(c.cmdMsg.Chat.ID, c.cmdMsg.ID, false)
+
+	if err != nil {
+		fmt.Println("    describe error:", err)
+		_, _ = c.reply(ctx, errorStr+": "+err.Error())
+		return
+	}
+
+	prompt := desc.Prompt
+	callbackData := callbackHandler.Register(func(ctx context.Context, cq *models.CallbackQuery, msg *models.Message) {
+		fmt.Println("  generating from described prompt")
+
+		// Using the bot's reply as the command message, so results get posted as a reply to it.
+		genMsg := *msg
+		genMsg.From = &cq.From
+		genMsg.Text = prompt
+		genMsg.ReplyToMessage = nil
+
+		cmdHandler, removeCmdHandler := addCmdHandler(&genMsg)
+		defer removeCmdHandler()
+		cmdHandler.Imagen(ctx)
+	})
+
+	text := "📝 " + desc.Description + "\n\n💡 !imagen " + prompt
+	text = truncateText(text, 4096)
+	_, _ = sendReplyToMessageWithMarkup(ctx, c.cmdMsg, text,
+		&models.InlineKeyboardMarkup{
+			InlineKeyboard: [][]models.InlineKeyboardButton{
+				{{Text: "🎨 Generate", CallbackData: callbackData}},
+			},
+		})
+}
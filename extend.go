@@ -0,0 +1,181 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"image"
+	"image/draw"
+	"strconv"
+	"strings"
+)
+
+const defaultExtendPrompt = "Extend the image to fill the transparent area seamlessly, matching the style, lighting and content of the original"
+
+type extendPaddingType struct {
+	left, right, top, bottom int
+}
+
+// extendCanvas pads the image with a transparent area, and returns the padded image and the matching mask,
+// which is transparent where the model should fill in the image.
+func extendCanvas(data []byte, pad extendPaddingType, aspectRatio string) (img, mask []byte, err error) {
+	src, _, err := decodeImage(data)
+	if err != nil {
+		return nil, nil, err
+	}
+	b := src.Bounds()
+	w := b.Dx() + pad.left + pad.right
+	h := b.Dy() + pad.top + pad.bottom
+
+	if aspectRatio != "" {
+		aw, ah, err := parseAspectRatio(aspectRatio)
+		if err != nil {
+			return nil, nil, err
+		}
+		// Extending evenly on the sides which are too short for the aspect ratio.
+		if w*ah < h*aw {
+			d := h*aw/ah - w
+			pad.left += d / 2
+			pad.right += d - d/2
+			w += d
+		} else {
+			d := w*ah/aw - h
+			pad.top += d / 2
+			pad.bottom += d - d/2
+			h += d
+		}
+	}
+
+	if w == b.Dx() && h == b.Dy() {
+		return nil, nil, fmt.Errorf("nothing to extend, use the -left, -right, -top, -bottom or -ar flags")
+	}
+	if w > maxInputImageDimension || h > maxInputImageDimension {
+		return nil, nil, fmt.Errorf("extended image would be %dx%d, max. size is %dpx", w, h, maxInputImageDimension)
+	}
+
+	canvas := image.NewNRGBA(image.Rect(0, 0, w, h))
+	draw.Draw(canvas, image.Rect(pad.left, pad.top, pad.left+b.Dx(), pad.top+b.Dy()), src, b.Min, draw.Src)
+
+	maskImg := image.NewNRGBA(canvas.Bounds())
+	draw.Draw(maskImg, image.Rect(pad.left, pad.top, pad.left+b.Dx(), pad.top+b.Dy()), image.White, image.Point{}, draw.Src)
+
+	if img, err = encodeImage(canvas, false); err != nil {
+		return nil, nil, err
+	}
+	if mask, err = encodeImage(maskImg, false); err != nil {
+		return nil, nil, err
+	}
+	return
+}
+
+func (c *cmdHandlerType) Extend(ctx context.Context) {
+	var pad extendPaddingType
+	var aspectRatio, model string
+	var promptParts []string
+
+	words := strings.Fields(c.cmdMsg.Text)
+	for i := 0; i < len(words); i++ {
+		argName := strings.TrimPrefix(words[i], "-")
+		switch {
+		case !strings.HasPrefix(words[i], "-"):
+			promptParts = append(promptParts, words[i])
+			continue
+		case argName != "left" && argName != "right" && argName != "top" && argName != "bottom" &&
+			argName != "ar" && argName != "model":
+			fmt.Println("	Invalid flag:", argName)
+			_, _ = c.reply(ctx, errorStr+": Invalid flag: "+argName)
+			return
+		case i+1 >= len(words):
+			fmt.Println("	Missing value for flag:", argName)
+			_, _ = c.reply(ctx, errorStr+": Missing value for flag: "+argName)
+			return
+		}
+
+		i++
+		value := words[i]
+		switch argName {
+		case "ar":
+			aspectRatio = value
+			continue
+		case "model":
+			model = value
+			continue
+		}
+
+		px, err := strconv.Atoi(value)
+		if err != nil || px < 0 || px > maxInputImageDimension {
+			fmt.Println("	Invalid value for", argName+":", value)
+			_, _ = c.reply(ctx, errorStr+": Invalid value for "+argName+": "+value)
+			return
+		}
+		switch argName {
+		case "left":
+			pad.left = px
+		case "right":
+			pad.right = px
+		case "top":
+			pad.top = px
+		case "bottom":
+			pad.bottom = px
+		}
+	}
+
+	prompt := strings.Join(promptParts, " ")
+	if prompt == "" {
+		prompt = defaultExtendPrompt
+	} else if reason := moderationHandler.ScreenPrompt(ctx, c.cmdMsg.From.ID, prompt); reason != "" {
+		fmt.Println("	Prompt rejected:", reason)
+		_, _ = c.reply(ctx, errorStr+": Prompt rejected, "+reason)
+		return
+	}
+
+	m, err := getImageModel(model)
+	if err == nil {
+		err = m.Validate(imagenArgsType{Prompt: prompt}, true)
+	}
+	if err != nil {
+		fmt.Println("	Invalid args:", err)
+		_, _ = c.reply(ctx, errorStr+": "+err.Error())
+		return
+	}
+
+	imgs, err := c.waitForImages(ctx)
+	if err == nil && len(imgs) == 0 {
+		fmt.Println("    canceled")
+		return
+	}
+	if err != nil {
+		fmt.Println("    error:", err)
+		_, _ = c.reply(ctx, errorStr+": "+err.Error())
+		return
+	}
+
+	img, mask, err := extendCanvas(imgs[0].Data, pad, aspectRatio)
+	if err != nil {
+		fmt.Println("    extend error:", err)
+		_, _ = c.reply(ctx, errorStr+": "+err.Error())
+		return
+	}
+
+	args := imagenArgsType{
+		N:      1,
+		Prompt: prompt,
+		Model:  model,
+		Mask:   mask,
+	}
+	// Requesting the supported size closest to the extended canvas, and cropping the result to its aspect ratio.
+	cw, ch, _ := parseDimensions(getImageSize(img), "x")
+	if args.Size, err = m.getNearestSize(cw, ch); err == nil {
+		args.ArgsPresent = []string{"size"}
+		args.Exact = fmt.Sprint(cw, ":", ch)
+	}
+
+	fmt.Println("    extending image to", cw, "x", ch, "prompt:", prompt)
+	imgs = []ImageFilesDataType{{
+		Data:     img,
+		Filename: "image.png",
+		MimeType: "image/png",
+	}}
+	c.confirmCost(ctx, args, len(imgs), func(ctx context.Context, c *cmdHandlerType, args imagenArgsType) {
+		c.ImagenEditImages(ctx, imgs, args)
+	})
+}
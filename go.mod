@@ -6,6 +6,7 @@ require (
 	github.com/go-telegram/bot v1.14.2
 	github.com/openai/openai-go v0.1.0-beta.10
 	golang.org/x/exp v0.0.0-20250408133849-7e4ce0ab07d0
+	golang.org/x/image v0.26.0
 )
 
 require (
@@ -0,0 +1,170 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"image"
+	"image/color"
+	"image/draw"
+	"math"
+	"strconv"
+
+	"github.com/go-telegram/bot"
+	"github.com/go-telegram/bot/models"
+	xdraw "golang.org/x/image/draw"
+	"golang.org/x/image/font"
+	"golang.org/x/image/font/basicfont"
+	"golang.org/x/image/math/fixed"
+)
+
+const gridCellMaxDimension = 768
+const gridGap = 8
+const gridLabelScale = 4
+const gridButtonsPerRow = 5
+const gridNoStorageChatStr = "grid mode is not available, as the storage chat is not set"
+
+// drawGridLabel draws the given number to the top left corner of the given cell.
+func drawGridLabel(dst draw.Image, cell image.Rectangle, n int) {
+	s := strconv.Itoa(n)
+	face := basicfont.Face7x13
+
+	// Drawing with the small bitmap font first, then scaling it up.
+	label := image.NewNRGBA(image.Rect(0, 0, len(s)*face.Advance+4, face.Height+2))
+	draw.Draw(label, label.Bounds(), image.NewUniform(color.NRGBA{0, 0, 0, 180}), image.Point{}, draw.Src)
+	d := font.Drawer{
+		Dst:  label,
+		Src:  image.White,
+		Face: face,
+		Dot:  fixed.P(2, face.Ascent+1),
+	}
+	d.DrawString(s)
+
+	lb := label.Bounds()
+	r := image.Rect(0, 0, lb.Dx()*gridLabelScale, lb.Dy()*gridLabelScale).Add(cell.Min).Add(image.Pt(gridGap, gridGap))
+	xdraw.NearestNeighbor.Scale(dst, r, label, lb, draw.Over, nil)
+}
+
+// buildGrid composites the given images into one numbered grid image.
+func buildGrid(imgs [][]byte) ([]byte, error) {
+	var decoded []image.Image
+	cellW, cellH := 0, 0
+	for _, d := range imgs {
+		img, _, err := image.Decode(bytes.NewReader(d))
+		if err != nil {
+			return nil, err
+		}
+		img = fitImage(img, gridCellMaxDimension)
+		cellW = max(cellW, img.Bounds().Dx())
+		cellH = max(cellH, img.Bounds().Dy())
+		decoded = append(decoded, img)
+	}
+
+	cols := int(math.Ceil(math.Sqrt(float64(len(decoded)))))
+	rows := (len(decoded) + cols - 1) / cols
+	grid := image.NewNRGBA(image.Rect(0, 0, cols*cellW+(cols+1)*gridGap, rows*cellH+(rows+1)*gridGap))
+	draw.Draw(grid, grid.Bounds(), image.White, image.Point{}, draw.Src)
+
+	for i, img := range decoded {
+		b := img.Bounds()
+		cell := image.Rect(0, 0, cellW, cellH).Add(image.Pt(gridGap+(i%cols)*(cellW+gridGap), gridGap+(i/cols)*(cellH+gridGap)))
+		// Centering the image in the cell.
+		r := b.Sub(b.Min).Add(cell.Min).Add(image.Pt((cellW-b.Dx())/2, (cellH-b.Dy())/2))
+		draw.Draw(grid, r, img, b.Min, draw.Over)
+		drawGridLabel(grid, r, i+1)
+	}
+	return encodeImage(grid, true)
+}
+
+// storeGridImages uploads the images as documents to the inline storage chat, and returns their file IDs.
+// This way the grid buttons don't have to keep the images in memory.
+func storeGridImages(ctx context.Context, imgs [][]byte) (fileIDs []string, err error) {
+	if params.InlineStorageChatID == 0 {
+		return nil, fmt.Errorf(gridNoStorageChatStr)
+	}
+	msgs, err := uploadDocuments(ctx, &models.Message{Chat: models.Chat{ID: params.InlineStorageChatID}}, "", imgs)
+	if err != nil {
+		return nil, err
+	}
+	for _, m := range msgs {
+		if m.Document == nil {
+			return nil, fmt.Errorf("stored grid image is not a document")
+		}
+		fileIDs = append(fileIDs, m.Document.FileID)
+	}
+	return
+}
+
+// sendGrid sends the images as one grid image with buttons for picking an image at full quality or for
+// editing it. The document file IDs of the stored images are returned too.
+func (c *cmdHandlerType) sendGrid(ctx context.Context, description string, imgs [][]byte) (gridMsg *models.Message,
+	fileIDs []string, err error) {
+
+	grid, err := buildGrid(imgs)
+	if err != nil {
+		return nil, nil, err
+	}
+	fileIDs, err = storeGridImages(ctx, imgs)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	var buttons [][]models.InlineKeyboardButton
+	var pickButtons, editButtons []models.InlineKeyboardButton
+	for i, fileID := range fileIDs {
+		if i > 0 && i%gridButtonsPerRow == 0 {
+			buttons = append(buttons, pickButtons, editButtons)
+			pickButtons, editButtons = nil, nil
+		}
+
+		n := strconv.Itoa(i + 1)
+		pickButtons = append(pickButtons, models.InlineKeyboardButton{
+			Text: "📥 Pick " + n,
+			CallbackData: callbackHandler.Register(func(ctx context.Context, cq *models.CallbackQuery, msg *models.Message) {
+				fmt.Println("  sending picked image", n)
+				_, err := telegramBot.SendDocument(ctx, &bot.SendDocumentParams{
+					ChatID:          msg.Chat.ID,
+					MessageThreadID: msg.MessageThreadID,
+					Document:        &models.InputFileString{Data: fileID},
+					Caption:         "📥 Image " + n,
+				})
+				if err != nil {
+					fmt.Println("  send document error:", err)
+				}
+			}),
+		})
+		editButtons = append(editButtons, models.InlineKeyboardButton{
+			Text: "✏️ Edit " + n,
+			CallbackData: callbackHandler.Register(func(ctx context.Context, cq *models.CallbackQuery, msg *models.Message) {
+				fmt.Println("  sending image", n, "for editing")
+				text := "✏️ Reply to this image with the edit prompt"
+				if msg.Chat.ID < 0 {
+					text = "✏️ Reply to this image with !imagen (prompt) to edit it"
+				}
+				_, err := telegramBot.SendDocument(ctx, &bot.SendDocumentParams{
+					ChatID:          msg.Chat.ID,
+					MessageThreadID: msg.MessageThreadID,
+					Document:        &models.InputFileString{Data: fileID},
+					Caption:         text,
+					ReplyMarkup:     &models.ForceReply{ForceReply: true},
+				})
+				if err != nil {
+					fmt.Println("  send document error:", err)
+				}
+			}),
+		})
+	}
+
+	buttons = append(buttons, pickButtons, editButtons)
+
+	description = truncateText(description, 1024)
+	gridMsg, err = telegramBot.SendPhoto(ctx, &bot.SendPhotoParams{
+		ChatID:          c.cmdMsg.Chat.ID,
+		MessageThreadID: c.cmdMsg.MessageThreadID,
+		ReplyParameters: &models.ReplyParameters{MessageID: c.cmdMsg.ID},
+		Photo:           &models.InputFileUpload{Filename: "grid.jpg", Data: bytes.NewReader(grid)},
+		Caption:         description,
+		ReplyMarkup:     &models.InlineKeyboardMarkup{InlineKeyboard: buttons},
+	})
+	return gridMsg, fileIDs, err
+}
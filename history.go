@@ -0,0 +1,54 @@
+package main
+
+import (
+	"strings"
+	"sync"
+	"time"
+)
+
+const historyMaxEntries = 1000
+
+type historyEntryType struct {
+	Time      time.Time
+	UserID    int64
+	ChatID    int64
+	Prompt    string
+	FileIDs   []string // Telegram file IDs of the uploaded result images.
+	Documents bool     // True if the file IDs are of documents, not photos.
+}
+
+type historyType struct {
+	mutex   sync.Mutex
+	entries []historyEntryType
+}
+
+var history historyType
+
+func (h *historyType) Add(entry historyEntryType) {
+	if len(entry.FileIDs) == 0 {
+		return
+	}
+
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	h.entries = append(h.entries, entry)
+	if len(h.entries) > historyMaxEntries {
+		h.entries = h.entries[len(h.entries)-historyMaxEntries:]
+	}
+}
+
+// FindByPrompt returns the user's newest entry with the given prompt, or nil if not found. Entries of other
+// users are never returned, as they may come from chats the user is not in.
+func (h *historyType) FindByPrompt(userID int64, prompt string) *historyEntryType {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	for i := len(h.entries) - 1; i >= 0; i-- {
+		if h.entries[i].UserID == userID && strings.EqualFold(h.entries[i].Prompt, prompt) {
+			entry := h.entries[i]
+			return &entry
+		}
+	}
+	return nil
+}
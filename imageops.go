@@ -0,0 +1,247 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"image"
+	"image/draw"
+	"image/gif"
+	"strconv"
+	"strings"
+
+	"golang.org/x/image/bmp"
+	"golang.org/x/image/tiff"
+)
+
+// Formats supported by the convert command.
+var convertFormats = []string{"png", "jpeg", "webp", "gif", "bmp", "tiff"}
+
+// imageOpType is a local image operation. The returned format is the output format, or an empty string to
+// keep the input format.
+type imageOpType func(img image.Image) (res image.Image, format string, err error)
+
+// encodeImageAs encodes the image in the given format.
+func encodeImageAs(img image.Image, format string) ([]byte, error) {
+	var buf bytes.Buffer
+	var err error
+	switch format {
+	case "png":
+		return encodeImage(img, false)
+	case "jpeg":
+		return encodeImage(img, true)
+	case "webp":
+		return encodeWebP(img)
+	case "gif":
+		err = gif.Encode(&buf, img, nil)
+	case "bmp":
+		err = bmp.Encode(&buf, img)
+	case "tiff":
+		err = tiff.Encode(&buf, img, &tiff.Options{Compression: tiff.Deflate})
+	default:
+		return nil, fmt.Errorf("unsupported output format %s, supported formats: %s", format, strings.Join(convertFormats, ", "))
+	}
+	return buf.Bytes(), err
+}
+
+// cropImage returns the given area of the image.
+func cropImage(src image.Image, r image.Rectangle) image.Image {
+	dst := image.NewNRGBA(image.Rect(0, 0, r.Dx(), r.Dy()))
+	draw.Draw(dst, dst.Bounds(), src, r.Min, draw.Src)
+	return dst
+}
+
+func parseCropOp(args []string) (imageOpType, error) {
+	if len(args) == 2 && args[0] == "-ar" {
+		w, h, err := parseDimensions(args[1], ":")
+		if err != nil {
+			return nil, fmt.Errorf("invalid aspect ratio: %s", args[1])
+		}
+		return func(img image.Image) (image.Image, string, error) {
+			return cropToAspect(img, w, h), "", nil
+		}, nil
+	}
+
+	var v []int
+	if len(args) == 1 {
+		for _, s := range strings.Split(args[0], ",") {
+			i, err := strconv.Atoi(strings.TrimSpace(s))
+			if err != nil || i < 0 {
+				break
+			}
+			v = append(v, i)
+		}
+	}
+	if len(v) != 4 || v[2] == 0 || v[3] == 0 {
+		return nil, fmt.Errorf("usage: x,y,w,h or -ar 16:9")
+	}
+	return func(img image.Image) (image.Image, string, error) {
+		b := img.Bounds()
+		r := image.Rect(v[0], v[1], v[0]+v[2], v[1]+v[3]).Add(b.Min).Intersect(b)
+		if r.Empty() {
+			return nil, "", fmt.Errorf("crop area is outside of the %dx%d image", b.Dx(), b.Dy())
+		}
+		return cropImage(img, r), "", nil
+	}, nil
+}
+
+func parseRotateOp(args []string) (imageOpType, error) {
+	var orientation int
+	if len(args) == 1 {
+		switch strings.TrimSuffix(args[0], "°") {
+		case "90", "-270":
+			orientation = orientationRotate90
+		case "180", "-180":
+			orientation = orientationRotate180
+		case "270", "-90":
+			orientation = orientationRotate270
+		}
+	}
+	if orientation == 0 {
+		return nil, fmt.Errorf("usage: 90, 180 or 270 (clockwise)")
+	}
+	return func(img image.Image) (image.Image, string, error) {
+		return transformImage(img, orientation), "", nil
+	}, nil
+}
+
+func parseFlipOp(args []string) (imageOpType, error) {
+	orientation := orientationFlipH
+	if len(args) == 1 && (args[0] == "v" || args[0] == "vertical") {
+		orientation = orientationFlipV
+	} else if len(args) > 1 || (len(args) == 1 && args[0] != "h" && args[0] != "horizontal") {
+		return nil, fmt.Errorf("usage: h or v (default is horizontal)")
+	}
+	return func(img image.Image) (image.Image, string, error) {
+		return transformImage(img, orientation), "", nil
+	}, nil
+}
+
+func parseResizeOp(args []string) (imageOpType, error) {
+	if len(args) != 1 {
+		return nil, fmt.Errorf("usage: 512 (longest side) or 512x384")
+	}
+	w, h, err := parseDimensions(args[0], "x")
+	if err != nil {
+		// Only the longest side is given.
+		if w, err = strconv.Atoi(args[0]); err != nil || w <= 0 {
+			return nil, fmt.Errorf("usage: 512 (longest side) or 512x384")
+		}
+	}
+	if w > maxInputImageDimension || h > maxInputImageDimension {
+		return nil, fmt.Errorf("max. size is %dpx", maxInputImageDimension)
+	}
+	return func(img image.Image) (image.Image, string, error) {
+		if h == 0 {
+			b := img.Bounds()
+			scale := float64(w) / float64(max(b.Dx(), b.Dy()))
+			return resizeImage(img, max(1, int(float64(b.Dx())*scale)), max(1, int(float64(b.Dy())*scale))), "", nil
+		}
+		return resizeImage(img, w, h), "", nil
+	}, nil
+}
+
+func parseConvertOp(args []string) (imageOpType, error) {
+	if len(args) != 1 {
+		return nil, fmt.Errorf("usage: format, supported formats: %s", strings.Join(convertFormats, ", "))
+	}
+	format := strings.ToLower(args[0])
+	switch format {
+	case "jpg":
+		format = "jpeg"
+	case "tif":
+		format = "tiff"
+	}
+	if _, err := encodeImageAs(image.NewNRGBA(image.Rect(0, 0, 1, 1)), format); err != nil {
+		return nil, err
+	}
+	return func(img image.Image) (image.Image, string, error) {
+		return img, format, nil
+	}, nil
+}
+
+// ImageOp runs the given local image operation on the replied or posted images.
+func (c *cmdHandlerType) ImageOp(ctx context.Context, cmd string) {
+	var op imageOpType
+	var err error
+	args := strings.Fields(c.cmdMsg.Text)
+	switch cmd {
+	case "imagencrop":
+		op, err = parseCropOp(args)
+	case "imagenrotate":
+		op, err = parseRotateOp(args)
+	case "imagenflip":
+		op, err = parseFlipOp(args)
+	case "imagenresize":
+		op, err = parseResizeOp(args)
+	case "imagenconvert":
+		op, err = parseConvertOp(args)
+	}
+	if err != nil {
+		fmt.Println("  invalid args:", err)
+		_, _ = c.reply(ctx, errorStr+": "+err.Error())
+		return
+	}
+
+	// Working on the original images, so they are not downscaled and re-encoded before the operation.
+	c.expectRawImages = true
+	imgs, err := c.waitForImages(ctx)
+	if err == nil && len(imgs) == 0 {
+		fmt.Println("    canceled")
+		return
+	}
+	if err != nil {
+		fmt.Println("    error:", err)
+		_, _ = c.reply(ctx, errorStr+": "+err.Error())
+		return
+	}
+
+	var res [][]byte
+	asDocument := false
+	for _, imgFile := range imgs {
+		img, inputFormat, err := decodeImage(imgFile.Data)
+		if err == nil {
+			if inputFormat == "jpeg" {
+				// The EXIF orientation is lost on re-encoding.
+				img = transformImage(img, getJPEGOrientation(imgFile.Data))
+			}
+			var format string
+			img, format, err = op(img)
+			if err == nil {
+				if format != "" {
+					// Converted images are sent as documents so Telegram doesn't convert them back to JPEG.
+					asDocument = true
+				} else {
+					format = inputFormat
+				}
+				metadata := readImageMetadata(imgFile.Data)
+				if imgFile.Data, err = encodeImageAs(img, format); err == nil && len(metadata) > 0 {
+					// Keeping the generation info, for formats which can store it.
+					imgFile.Data = addImageMetadata(imgFile.Data, metadata)
+				}
+			}
+		}
+		if err != nil {
+			fmt.Println("    image op error:", err)
+			_, _ = c.reply(ctx, errorStr+": "+err.Error())
+			return
+		}
+		// Transparent images would lose their alpha channel as photos.
+		if !asDocument && hasTransparency(imgFile.Data) {
+			asDocument = true
+		}
+		res = append(res, imgFile.Data)
+	}
+
+	description := "🛠️ " + strings.TrimSpace(cmd[len("imagen"):]+" "+c.cmdMsg.Text)
+	if asDocument {
+		_, err = uploadDocuments(ctx, c.cmdMsg, description, res)
+	} else {
+		_, err = uploadImages(ctx, c.cmdMsg, description, res)
+	}
+	if err != nil {
+		_, _ = c.reply(ctx, errorStr+": "+err.Error())
+		return
+	}
+	fmt.Println("    images uploaded successfully")
+}
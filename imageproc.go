@@ -0,0 +1,275 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"image"
+	"image/draw"
+	_ "image/gif"
+	"image/jpeg"
+	"image/png"
+	"path/filepath"
+	"strings"
+
+	xdraw "golang.org/x/image/draw"
+
+	_ "golang.org/x/image/bmp"
+	_ "golang.org/x/image/tiff"
+	_ "golang.org/x/image/webp"
+)
+
+const maxInputImageDimension = 4096
+const maxInputImageBytes = 50 * 1024 * 1024 // OpenAI API limit for edit input images.
+const maxDecodedImagePixels = 8192 * 8192   // Larger images are rejected before decoding.
+const maxSquarePNGDimension = 1024
+const maxSquarePNGBytes = 4 * 1024 * 1024
+
+const unsupportedImageFormatStr = "unsupported image format, supported formats are PNG, JPEG, WebP, GIF, BMP and TIFF"
+
+// EXIF orientation values, see https://www.exif.org/Exif2-2.PDF
+const (
+	orientationNormal     = 1
+	orientationFlipH      = 2
+	orientationRotate180  = 3
+	orientationFlipV      = 4
+	orientationTranspose  = 5
+	orientationRotate90   = 6 // Clockwise.
+	orientationTransverse = 7
+	orientationRotate270  = 8 // Clockwise.
+)
+
+// getJPEGOrientation returns the EXIF orientation of the given JPEG data, or orientationNormal if not found.
+func getJPEGOrientation(data []byte) int {
+	if len(data) < 4 || data[0] != 0xff || data[1] != 0xd8 {
+		return orientationNormal
+	}
+
+	pos := 2
+	for pos+4 <= len(data) {
+		if data[pos] != 0xff {
+			return orientationNormal
+		}
+		marker := data[pos+1]
+		segLen := int(binary.BigEndian.Uint16(data[pos+2:]))
+		if marker == 0xda || segLen < 2 || pos+2+segLen > len(data) { // Start of scan or invalid segment.
+			return orientationNormal
+		}
+		seg := data[pos+4 : pos+2+segLen]
+		if marker == 0xe1 && len(seg) > 14 && string(seg[:6]) == "Exif\x00\x00" {
+			return getTIFFOrientation(seg[6:])
+		}
+		pos += 2 + segLen
+	}
+	return orientationNormal
+}
+
+func getTIFFOrientation(tiff []byte) int {
+	var bo binary.ByteOrder
+	switch string(tiff[:2]) {
+	case "II":
+		bo = binary.LittleEndian
+	case "MM":
+		bo = binary.BigEndian
+	default:
+		return orientationNormal
+	}
+
+	ifdOffset := int(bo.Uint32(tiff[4:]))
+	if ifdOffset+2 > len(tiff) {
+		return orientationNormal
+	}
+	entryCount := int(bo.Uint16(tiff[ifdOffset:]))
+	for i := 0; i < entryCount; i++ {
+		entry := ifdOffset + 2 + i*12
+		if entry+12 > len(tiff) {
+			break
+		}
+		if bo.Uint16(tiff[entry:]) == 0x0112 {
+			o := int(bo.Uint16(tiff[entry+8:]))
+			if o < orientationNormal || o > orientationRotate270 {
+				return orientationNormal
+			}
+			return o
+		}
+	}
+	return orientationNormal
+}
+
+// transformImage applies the given EXIF orientation transform to the image.
+func transformImage(src image.Image, orientation int) image.Image {
+	if orientation == orientationNormal {
+		return src
+	}
+
+	b := src.Bounds()
+	w, h := b.Dx(), b.Dy()
+	var dst *image.NRGBA
+	switch orientation {
+	case orientationTranspose, orientationRotate90, orientationTransverse, orientationRotate270:
+		dst = image.NewNRGBA(image.Rect(0, 0, h, w))
+	default:
+		dst = image.NewNRGBA(image.Rect(0, 0, w, h))
+	}
+
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			var dx, dy int
+			switch orientation {
+			case orientationFlipH:
+				dx, dy = w-1-x, y
+			case orientationRotate180:
+				dx, dy = w-1-x, h-1-y
+			case orientationFlipV:
+				dx, dy = x, h-1-y
+			case orientationTranspose:
+				dx, dy = y, x
+			case orientationRotate90:
+				dx, dy = h-1-y, x
+			case orientationTransverse:
+				dx, dy = h-1-y, w-1-x
+			case orientationRotate270:
+				dx, dy = y, w-1-x
+			}
+			dst.Set(dx, dy, src.At(b.Min.X+x, b.Min.Y+y))
+		}
+	}
+	return dst
+}
+
+// resizeImage scales the image to the given size.
+func resizeImage(src image.Image, width, height int) image.Image {
+	dst := image.NewNRGBA(image.Rect(0, 0, width, height))
+	xdraw.CatmullRom.Scale(dst, dst.Bounds(), src, src.Bounds(), draw.Src, nil)
+	return dst
+}
+
+// fitImage downscales the image so its longest side is at most maxDimension.
+func fitImage(src image.Image, maxDimension int) image.Image {
+	b := src.Bounds()
+	if b.Dx() <= maxDimension && b.Dy() <= maxDimension {
+		return src
+	}
+	scale := float64(maxDimension) / float64(max(b.Dx(), b.Dy()))
+	return resizeImage(src, max(1, int(float64(b.Dx())*scale)), max(1, int(float64(b.Dy())*scale)))
+}
+
+func encodeImage(img image.Image, asJPEG bool) ([]byte, error) {
+	var buf bytes.Buffer
+	var err error
+	if asJPEG {
+		err = jpeg.Encode(&buf, img, &jpeg.Options{Quality: 95})
+	} else {
+		err = png.Encode(&buf, img)
+	}
+	return buf.Bytes(), err
+}
+
+// decodeImage decodes untrusted image data. The dimensions are checked before decoding, so small files
+// decompressing to huge images can't exhaust the memory.
+func decodeImage(data []byte) (image.Image, string, error) {
+	cfg, _, err := image.DecodeConfig(bytes.NewReader(data))
+	if err != nil {
+		return nil, "", fmt.Errorf(unsupportedImageFormatStr)
+	}
+	if cfg.Width <= 0 || cfg.Height <= 0 || int64(cfg.Width)*int64(cfg.Height) > maxDecodedImagePixels {
+		return nil, "", fmt.Errorf("image is too large (%dx%d), max. %d megapixels", cfg.Width, cfg.Height,
+			maxDecodedImagePixels/1000000)
+	}
+	img, format, err := image.Decode(bytes.NewReader(data))
+	if err != nil {
+		return nil, "", fmt.Errorf(unsupportedImageFormatStr)
+	}
+	return img, format, nil
+}
+
+// preprocessImage decodes the given image data, honours the EXIF orientation, downsizes it if it's too big,
+// and re-encodes it as PNG (or JPEG if it was a JPEG), which also strips all metadata.
+func preprocessImage(data []byte, filename string) (ImageFilesDataType, error) {
+	img, format, err := decodeImage(data)
+	if err != nil {
+		return ImageFilesDataType{}, err
+	}
+
+	asJPEG := format == "jpeg"
+	if asJPEG {
+		img = transformImage(img, getJPEGOrientation(data))
+	}
+	img = fitImage(img, maxInputImageDimension)
+
+	d, err := encodeImage(img, asJPEG)
+	if err != nil {
+		return ImageFilesDataType{}, fmt.Errorf("can't encode image: %w", err)
+	}
+	for len(d) > maxInputImageBytes {
+		b := img.Bounds()
+		img = fitImage(img, max(b.Dx(), b.Dy())*3/4)
+		d, err = encodeImage(img, asJPEG)
+		if err != nil {
+			return ImageFilesDataType{}, fmt.Errorf("can't encode image: %w", err)
+		}
+	}
+
+	if filename == "" {
+		filename = "image"
+	}
+	filename = strings.TrimSuffix(filename, filepath.Ext(filename))
+	res := ImageFilesDataType{Data: d}
+	if asJPEG {
+		res.Filename = filename + ".jpg"
+		res.MimeType = "image/jpeg"
+	} else {
+		res.Filename = filename + ".png"
+		res.MimeType = "image/png"
+	}
+	return res, nil
+}
+
+// convertToSquarePNG centers the image on a transparent square canvas, and encodes it as a PNG smaller than
+// maxSquarePNGBytes, as some models only accept such edit input images. Transparent areas are edited by
+// these models, so the added borders get filled in, and a mask converted the same way keeps matching the
+// image.
+func convertToSquarePNG(data []byte) ([]byte, error) {
+	img, _, err := decodeImage(data)
+	if err != nil {
+		return nil, err
+	}
+
+	b := img.Bounds()
+	side := max(b.Dx(), b.Dy())
+	square := image.NewNRGBA(image.Rect(0, 0, side, side))
+	draw.Draw(square, image.Rect((side-b.Dx())/2, (side-b.Dy())/2, side, side), img, b.Min, draw.Src)
+
+	dim := min(side, maxSquarePNGDimension)
+	for {
+		d, err := encodeImage(fitImage(square, dim), false)
+		if err != nil {
+			return nil, fmt.Errorf("can't encode image: %w", err)
+		}
+		if len(d) <= maxSquarePNGBytes {
+			return d, nil
+		}
+		dim = dim * 3 / 4
+	}
+}
+
+// convertToSquarePNGs converts the given images and mask with convertToSquarePNG.
+func convertToSquarePNGs(imgs []ImageFilesDataType, mask []byte) (res []ImageFilesDataType, resMask []byte, err error) {
+	for _, img := range imgs {
+		d, err := convertToSquarePNG(img.Data)
+		if err != nil {
+			return nil, nil, err
+		}
+		res = append(res, ImageFilesDataType{
+			Data:     d,
+			Filename: strings.TrimSuffix(img.Filename, filepath.Ext(img.Filename)) + ".png",
+			MimeType: "image/png",
+		})
+	}
+	if len(mask) > 0 {
+		if resMask, err = convertToSquarePNG(mask); err != nil {
+			return nil, nil, fmt.Errorf("can't convert mask: %w", err)
+		}
+	}
+	return
+}
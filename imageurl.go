@@ -0,0 +1,128 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"path"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/go-telegram/bot/models"
+)
+
+const maxImageURLBytes = 20 * 1024 * 1024
+const imageURLFetchTimeout = 30 * time.Second
+const maxImageURLRedirects = 5
+
+var cgnatNet = &net.IPNet{IP: net.IPv4(100, 64, 0, 0), Mask: net.CIDRMask(10, 32)}
+
+func isPublicIP(ip net.IP) bool {
+	return !ip.IsLoopback() && !ip.IsPrivate() && !ip.IsLinkLocalUnicast() && !ip.IsLinkLocalMulticast() &&
+		!ip.IsInterfaceLocalMulticast() && !ip.IsMulticast() && !ip.IsUnspecified() && !cgnatNet.Contains(ip)
+}
+
+// The address check is done after DNS resolution when connecting, so DNS rebinding can't be used to reach
+// private addresses.
+var imageURLHTTPClient = &http.Client{
+	Timeout: imageURLFetchTimeout,
+	Transport: &http.Transport{
+		DialContext: (&net.Dialer{
+			Timeout: 10 * time.Second,
+			Control: func(network, address string, _ syscall.RawConn) error {
+				host, _, err := net.SplitHostPort(address)
+				if err != nil {
+					return err
+				}
+				ip := net.ParseIP(host)
+				if ip == nil || !isPublicIP(ip) {
+					return fmt.Errorf("address %s is not allowed", host)
+				}
+				return nil
+			},
+		}).DialContext,
+		TLSHandshakeTimeout:   10 * time.Second,
+		ResponseHeaderTimeout: 10 * time.Second,
+	},
+	CheckRedirect: func(req *http.Request, via []*http.Request) error {
+		if len(via) >= maxImageURLRedirects {
+			return fmt.Errorf("too many redirects")
+		}
+		if req.URL.Scheme != "http" && req.URL.Scheme != "https" {
+			return fmt.Errorf("unsupported url scheme: %s", req.URL.Scheme)
+		}
+		return nil
+	},
+}
+
+func isImageURL(s string) bool {
+	return strings.HasPrefix(s, "http://") || strings.HasPrefix(s, "https://")
+}
+
+// getMessageImageURLs returns the URLs found in the given message's text, text links and link preview.
+func getMessageImageURLs(msg *models.Message) (urls []string) {
+	addURL := func(u string) {
+		for _, existing := range urls {
+			if existing == u {
+				return
+			}
+		}
+		urls = append(urls, u)
+	}
+
+	for _, word := range strings.Fields(msg.Text) {
+		if isImageURL(word) {
+			addURL(word)
+		}
+	}
+	for _, e := range msg.Entities {
+		if e.Type == models.MessageEntityTypeTextLink && isImageURL(e.URL) {
+			addURL(e.URL)
+		}
+	}
+	if msg.LinkPreviewOptions != nil && msg.LinkPreviewOptions.URL != nil && isImageURL(*msg.LinkPreviewOptions.URL) {
+		addURL(*msg.LinkPreviewOptions.URL)
+	}
+	return
+}
+
+func downloadImageURL(ctx context.Context, imageURL string) (img ImageFilesDataType, err error) {
+	u, err := url.Parse(imageURL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") {
+		return img, fmt.Errorf("invalid url: %s", imageURL)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u.String(), nil)
+	if err != nil {
+		return img, err
+	}
+	resp, err := imageURLHTTPClient.Do(req)
+	if err != nil {
+		return img, fmt.Errorf("can't download %s: %w", imageURL, err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return img, fmt.Errorf("can't download %s: %s", imageURL, resp.Status)
+	}
+	if !strings.HasPrefix(resp.Header.Get("Content-Type"), "image/") {
+		return img, fmt.Errorf("%s is not an image", imageURL)
+	}
+	if resp.ContentLength > maxImageURLBytes {
+		return img, fmt.Errorf("%s is too big", imageURL)
+	}
+
+	d, err := io.ReadAll(io.LimitReader(resp.Body, maxImageURLBytes+1))
+	if err != nil {
+		return img, fmt.Errorf("can't download %s: %w", imageURL, err)
+	}
+	if len(d) > maxImageURLBytes {
+		return img, fmt.Errorf("%s is too big", imageURL)
+	}
+
+	return preprocessImage(d, path.Base(u.Path))
+}
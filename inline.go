@@ -0,0 +1,256 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-telegram/bot"
+	"github.com/go-telegram/bot/models"
+	"github.com/openai/openai-go"
+	"golang.org/x/exp/slices"
+)
+
+const inlineQueryDebounceDelay = 1500 * time.Millisecond
+
+type inlineHandlerType struct {
+	mutex             sync.Mutex
+	debounceTimers    map[int64]*time.Timer // map[UserID]Timer
+	inProgressPrompts map[string]bool       // User IDs and prompts (lowercase) which are being generated.
+	generationTimes   map[int64][]time.Time // map[UserID]GenerationStartTimes, for the last hour.
+}
+
+var inlineHandler inlineHandlerType
+
+func (i *inlineHandlerType) Init() {
+	i.debounceTimers = make(map[int64]*time.Timer)
+	i.inProgressPrompts = make(map[string]bool)
+	i.generationTimes = make(map[int64][]time.Time)
+}
+
+func (i *inlineHandlerType) answer(ctx context.Context, queryID string, results []models.InlineQueryResult, buttonText string) {
+	params := &bot.AnswerInlineQueryParams{
+		InlineQueryID: queryID,
+		Results:       results,
+		IsPersonal:    true,
+	}
+	if buttonText != "" {
+		params.Button = &models.InlineQueryResultsButton{
+			Text:           buttonText,
+			StartParameter: "inline",
+		}
+	}
+	if results == nil {
+		params.Results = []models.InlineQueryResult{}
+	}
+	_, err := telegramBot.AnswerInlineQuery(ctx, params)
+	if err != nil {
+		fmt.Println("  answer inline query error:", err)
+	}
+}
+
+// HandleQuery debounces the incoming inline queries, so only the last query typed by the user gets processed.
+func (i *inlineHandlerType) HandleQuery(ctx context.Context, q *models.InlineQuery) {
+	if !slices.Contains(params.AllowedUserIDs, q.From.ID) {
+		fmt.Println("inline query from", q.From.Username, "#", q.From.ID, "not allowed, ignoring")
+		i.answer(ctx, q.ID, nil, "")
+		return
+	}
+
+	i.mutex.Lock()
+	defer i.mutex.Unlock()
+
+	if t, ok := i.debounceTimers[q.From.ID]; ok {
+		t.Stop()
+	}
+	i.debounceTimers[q.From.ID] = time.AfterFunc(inlineQueryDebounceDelay, func() {
+		i.mutex.Lock()
+		delete(i.debounceTimers, q.From.ID)
+		i.mutex.Unlock()
+
+		i.processQuery(ctx, q)
+	})
+}
+
+// checkBudget returns true if the user can start a new generation, and records the generation start if so.
+func (i *inlineHandlerType) checkBudget(userID int64) bool {
+	if params.InlineMaxImagesPerHour == 0 {
+		return true
+	}
+
+	var times []time.Time
+	for _, t := range i.generationTimes[userID] {
+		if time.Since(t) < time.Hour {
+			times = append(times, t)
+		}
+	}
+	if len(times) >= params.InlineMaxImagesPerHour {
+		i.generationTimes[userID] = times
+		return false
+	}
+	i.generationTimes[userID] = append(times, time.Now())
+	return true
+}
+
+func (i *inlineHandlerType) processQuery(ctx context.Context, q *models.InlineQuery) {
+	prompt := strings.TrimSpace(q.Query)
+	fmt.Print("inline query from ", q.From.Username, "#", q.From.ID, ": ", prompt, "\n")
+
+	if prompt == "" {
+		i.answer(ctx, q.ID, nil, "")
+		return
+	}
+
+	if entry := history.FindByPrompt(q.From.ID, prompt); entry != nil {
+		fmt.Println("  answering with", len(entry.FileIDs), "cached images")
+		var results []models.InlineQueryResult
+		for n, fileID := range entry.FileIDs {
+			if entry.Documents {
+				results = append(results, &models.InlineQueryResultCachedDocument{
+					ID:             strconv.Itoa(n),
+					DocumentFileID: fileID,
+					Title:          prompt,
+					Caption:        "💭 " + prompt,
+				})
+				continue
+			}
+			results = append(results, &models.InlineQueryResultCachedPhoto{
+				ID:          strconv.Itoa(n),
+				PhotoFileID: fileID,
+				Title:       prompt,
+				Caption:     "💭 " + prompt,
+			})
+		}
+		i.answer(ctx, q.ID, results, "")
+		return
+	}
+
+	if reason := moderationHandler.ScreenPrompt(ctx, q.From.ID, prompt); reason != "" {
+		fmt.Println("  prompt rejected:", reason)
+		i.answer(ctx, q.ID, nil, "❌ Prompt rejected, "+reason)
+		return
+	}
+
+	promptKey := fmt.Sprint(q.From.ID, ":", strings.ToLower(prompt))
+
+	i.mutex.Lock()
+	if i.inProgressPrompts[promptKey] {
+		i.mutex.Unlock()
+		fmt.Println("  generation already in progress")
+		i.answer(ctx, q.ID, nil, "⏳ Generating, please wait...")
+		return
+	}
+	if err := rateLimiter.Check(q.From.ID, 0, 1); err != nil {
+		i.mutex.Unlock()
+		fmt.Println("  rate limited:", err)
+		i.answer(ctx, q.ID, nil, "⏳ "+err.Error())
+		return
+	}
+	if !i.checkBudget(q.From.ID) {
+		i.mutex.Unlock()
+		fmt.Println("  inline generation limit reached")
+		i.answer(ctx, q.ID, nil, "❌ Inline generation limit reached, try again later")
+		return
+	}
+	i.inProgressPrompts[promptKey] = true
+	i.mutex.Unlock()
+
+	i.answer(ctx, q.ID, nil, "⏳ Generating, please wait...")
+
+	if !jobTracker.Start() {
+		i.mutex.Lock()
+		delete(i.inProgressPrompts, promptKey)
+		i.mutex.Unlock()
+		return
+	}
+
+	// The request is only counted when the generation starts.
+	if err := rateLimiter.Allow(q.From.ID, 0, 1); err != nil {
+		jobTracker.Done()
+		i.mutex.Lock()
+		delete(i.inProgressPrompts, promptKey)
+		i.mutex.Unlock()
+		fmt.Println("  rate limited:", err)
+		return
+	}
+
+	go func() {
+		defer jobTracker.Done()
+		defer func() {
+			i.mutex.Lock()
+			delete(i.inProgressPrompts, promptKey)
+			i.mutex.Unlock()
+		}()
+
+		if err := i.generate(customKeys.WithContext(ctx, q.From.ID, q.From.ID), q.From, prompt); err != nil {
+			fmt.Println("  inline generate error:", err)
+			_, _ = sendMessage(ctx, q.From.ID, errorStr+": inline generation of \""+prompt+"\" failed: "+err.Error())
+		}
+	}()
+}
+
+// generate generates images for the given prompt and uploads them to Telegram so they get a file ID which
+// can be used in inline query results.
+func (i *inlineHandlerType) generate(ctx context.Context, user *models.User, prompt string) error {
+	fmt.Println("  sending inline generate request...")
+	res, err := imagenGenerateRequest(ctx, imagenArgsType{
+		N:          1,
+		Prompt:     prompt,
+		Size:       string(openai.ImageEditParamsSize1024x1024),
+		Background: "opaque",
+		Quality:    "auto",
+	}, params.Moderation)
+	if err != nil {
+		return err
+	}
+
+	imgs, err := decodeImagesResponse(&res)
+	if err != nil {
+		return err
+	}
+
+	storageChatID := params.InlineStorageChatID
+	if storageChatID == 0 {
+		storageChatID = user.ID
+	}
+
+	var msgs []*models.Message
+	for _, img := range imgs {
+		msg, err := telegramBot.SendPhoto(ctx, &bot.SendPhotoParams{
+			ChatID: storageChatID,
+			Photo: &models.InputFileUpload{
+				Filename: fmt.Sprintf("imagen-%s.png", time.Now().Format("060102-150405")),
+				Data:     bytes.NewReader(img),
+			},
+			Caption: "💭 " + prompt,
+		})
+		if err != nil {
+			return err
+		}
+		msgs = append(msgs, msg)
+
+		if params.InlineStorageChatID == 0 {
+			// The file ID stays valid after the message got deleted from the user's private chat.
+			_, _ = telegramBot.DeleteMessage(ctx, &bot.DeleteMessageParams{
+				ChatID:    storageChatID,
+				MessageID: msg.ID,
+			})
+		}
+	}
+
+	archiveResults(ctx, user, nil, "💭 "+prompt, msgs)
+
+	history.Add(historyEntryType{
+		Time:    time.Now(),
+		UserID:  user.ID,
+		ChatID:  storageChatID,
+		Prompt:  prompt,
+		FileIDs: getPhotoFileIDs(msgs),
+	})
+	fmt.Println("  inline images ready")
+	return nil
+}
@@ -0,0 +1,286 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/go-telegram/bot/models"
+)
+
+const (
+	interruptedJobModeRerun  = "rerun"
+	interruptedJobModeNotify = "notify"
+	interruptedJobModeOff    = "off"
+)
+
+// journalJobType holds everything needed to re-run an accepted job after a restart.
+type journalJobType struct {
+	ID              string             `json:"id"`
+	CreatedAt       time.Time          `json:"created_at"`
+	ChatID          int64              `json:"chat_id"`
+	MessageID       int                `json:"message_id"`
+	MessageThreadID int                `json:"message_thread_id,omitempty"`
+	FromID          int64              `json:"from_id"`
+	FromUsername    string             `json:"from_username,omitempty"`
+	Args            imagenArgsType     `json:"args"`
+	Images          []journalImageType `json:"images,omitempty"` // Input images of edit jobs.
+	HasMask         bool               `json:"has_mask,omitempty"`
+}
+
+// journalImageType describes an input image, the image data is stored in the job's files dir.
+type journalImageType struct {
+	Filename string `json:"filename"`
+	MimeType string `json:"mime_type"`
+}
+
+// The journal stores accepted jobs as files in the data dir before they are executed, and removes them
+// after the results got uploaded, so the files left there on startup belong to interrupted jobs. Input
+// images and masks are stored as separate files in a dir named after the job, so the job files stay small.
+type journalType struct {
+	dir string
+}
+
+var journal journalType
+
+func (j *journalType) Init() error {
+	if params.InterruptedJobMode == interruptedJobModeOff {
+		return nil
+	}
+
+	j.dir = filepath.Join(params.DataDir, "jobs")
+	if err := os.MkdirAll(j.dir, 0700); err != nil {
+		return fmt.Errorf("can't create jobs dir: %w", err)
+	}
+	return nil
+}
+
+func (j *journalType) getFilename(id string) string {
+	return filepath.Join(j.dir, id+".json")
+}
+
+func (j *journalType) getFilesDir(id string) string {
+	return filepath.Join(j.dir, id)
+}
+
+func (j *journalType) getImageFilename(id string, i int) string {
+	return filepath.Join(j.getFilesDir(id), fmt.Sprint("image", i))
+}
+
+func (j *journalType) getMaskFilename(id string) string {
+	return filepath.Join(j.getFilesDir(id), "mask.png")
+}
+
+// writeFiles stores the input images and the mask of the job.
+func (j *journalType) writeFiles(job *journalJobType, imgs []ImageFilesDataType, mask []byte) error {
+	if len(imgs) == 0 && len(mask) == 0 {
+		return nil
+	}
+	if err := os.MkdirAll(j.getFilesDir(job.ID), 0700); err != nil {
+		return err
+	}
+	for i, img := range imgs {
+		if err := os.WriteFile(j.getImageFilename(job.ID, i), img.Data, 0600); err != nil {
+			return err
+		}
+		job.Images = append(job.Images, journalImageType{Filename: img.Filename, MimeType: img.MimeType})
+	}
+	if len(mask) > 0 {
+		if err := os.WriteFile(j.getMaskFilename(job.ID), mask, 0600); err != nil {
+			return err
+		}
+		job.HasMask = true
+	}
+	return nil
+}
+
+// readFiles returns the input images and the mask of the job.
+func (j *journalType) readFiles(job journalJobType) (imgs []ImageFilesDataType, mask []byte, err error) {
+	for i, img := range job.Images {
+		d, err := os.ReadFile(j.getImageFilename(job.ID, i))
+		if err != nil {
+			return nil, nil, err
+		}
+		imgs = append(imgs, ImageFilesDataType{Data: d, Filename: img.Filename, MimeType: img.MimeType})
+	}
+	if job.HasMask {
+		if mask, err = os.ReadFile(j.getMaskFilename(job.ID)); err != nil {
+			return nil, nil, err
+		}
+	}
+	return
+}
+
+func (j *journalType) remove(id string) {
+	_ = os.Remove(j.getFilename(id))
+	_ = os.RemoveAll(j.getFilesDir(id))
+}
+
+// Add journals a job before execution. Returns the job ID, or an empty string if journaling is disabled
+// or failed.
+func (j *journalType) Add(msg *models.Message, args imagenArgsType, imgs []ImageFilesDataType) string {
+	if j.dir == "" {
+		return ""
+	}
+
+	job := journalJobType{
+		ID:              fmt.Sprint(msg.Chat.ID, "_", msg.ID, "_", time.Now().UnixNano()),
+		CreatedAt:       time.Now(),
+		ChatID:          msg.Chat.ID,
+		MessageID:       msg.ID,
+		MessageThreadID: msg.MessageThreadID,
+		Args:            args,
+	}
+	if msg.From != nil {
+		job.FromID = msg.From.ID
+		job.FromUsername = msg.From.Username
+	}
+
+	if err := j.writeFiles(&job, imgs, args.Mask); err != nil {
+		fmt.Println("    journal write error:", err)
+		j.remove(job.ID)
+		return ""
+	}
+
+	d, err := json.Marshal(job)
+	if err != nil {
+		fmt.Println("    journal marshal error:", err)
+		j.remove(job.ID)
+		return ""
+	}
+
+	// Writing to a temp file first, so a crash during writing won't leave a corrupted job file behind.
+	filename := j.getFilename(job.ID)
+	if err := os.WriteFile(filename+".tmp", d, 0600); err != nil {
+		fmt.Println("    journal write error:", err)
+		j.remove(job.ID)
+		return ""
+	}
+	if err := os.Rename(filename+".tmp", filename); err != nil {
+		fmt.Println("    journal write error:", err)
+		j.remove(job.ID)
+		return ""
+	}
+	return job.ID
+}
+
+// Finish removes the job from the journal, except if the job got interrupted by a shutdown.
+func (j *journalType) Finish(ctx context.Context, id string) {
+	if id == "" || ctx.Err() != nil {
+		return
+	}
+	if err := os.Remove(j.getFilename(id)); err != nil {
+		fmt.Println("    journal remove error:", err)
+	}
+	_ = os.RemoveAll(j.getFilesDir(id))
+}
+
+func (j *journalType) load() (jobs []journalJobType) {
+	entries, err := os.ReadDir(j.dir)
+	if err != nil {
+		fmt.Println("  can't read jobs dir:", err)
+		return
+	}
+
+	for _, e := range entries {
+		filename := filepath.Join(j.dir, e.Name())
+		if e.IsDir() {
+			// Removing the files of jobs which have no job file.
+			if _, err := os.Stat(j.getFilename(e.Name())); os.IsNotExist(err) {
+				_ = os.RemoveAll(filename)
+			}
+			continue
+		}
+		if !strings.HasSuffix(e.Name(), ".json") {
+			_ = os.Remove(filename) // Leftover temp file.
+			continue
+		}
+
+		d, err := os.ReadFile(filename)
+		if err != nil {
+			fmt.Println("  can't read job file", e.Name()+":", err)
+			continue
+		}
+		var job journalJobType
+		if err := json.Unmarshal(d, &job); err != nil {
+			fmt.Println("  invalid job file", e.Name()+", removing:", err)
+			j.remove(strings.TrimSuffix(e.Name(), ".json"))
+			continue
+		}
+		jobs = append(jobs, job)
+	}
+	return
+}
+
+// ResumeJobs handles the jobs interrupted by the last shutdown, according to the configured mode.
+func (j *journalType) ResumeJobs(ctx context.Context) {
+	if j.dir == "" {
+		return
+	}
+
+	for _, job := range j.load() {
+		imgs, mask, err := j.readFiles(job)
+		j.remove(job.ID)
+		if err != nil {
+			fmt.Println("  can't read the files of interrupted job", job.ID+":", err)
+			continue
+		}
+		job.Args.Mask = mask
+
+		if time.Since(job.CreatedAt) > params.InterruptedJobMaxAge {
+			fmt.Println("  skipping interrupted job", job.ID, "as it's too old")
+			continue
+		}
+
+		msg := &models.Message{
+			ID:              job.MessageID,
+			MessageThreadID: job.MessageThreadID,
+			Chat:            models.Chat{ID: job.ChatID},
+			From: &models.User{
+				ID:       job.FromID,
+				Username: job.FromUsername,
+			},
+			Text: job.Args.Prompt,
+		}
+
+		if params.InterruptedJobMode == interruptedJobModeNotify {
+			fmt.Println("  notifying about interrupted job", job.ID)
+			_, _ = sendReplyToMessage(ctx, msg, errorStr+": your request got interrupted by a bot restart, please try again")
+			continue
+		}
+
+		if !jobTracker.Start() {
+			return
+		}
+		fmt.Println("  re-running interrupted job", job.ID)
+		go func(job journalJobType, imgs []ImageFilesDataType) {
+			defer jobTracker.Done()
+
+			ctx := customKeys.WithContext(ctx, job.ChatID, job.FromID)
+
+			cmdHandler, removeCmdHandler := addCmdHandler(msg)
+			defer removeCmdHandler()
+
+			_, _ = cmdHandler.reply(ctx, "🔄 Re-running your request interrupted by a bot restart")
+			if len(imgs) > 0 {
+				cmdHandler.ImagenEditImages(ctx, imgs, job.Args)
+			} else {
+				cmdHandler.ImagenGenerate(ctx, job.Args)
+			}
+		}(job, imgs)
+	}
+}
+
+func parseInterruptedJobMode(mode string) (string, error) {
+	switch mode {
+	case "":
+		return interruptedJobModeRerun, nil
+	case interruptedJobModeRerun, interruptedJobModeNotify, interruptedJobModeOff:
+		return mode, nil
+	}
+	return "", fmt.Errorf("invalid interrupted job mode: %s", mode)
+}
@@ -4,30 +4,30 @@ import (
 	"bytes"
 	"context"
 	"fmt"
+	"image"
 	"io"
 	"net/http"
 	"os"
 	"os/signal"
 	"strings"
 	"sync"
+	"syscall"
 	"time"
+	"unicode/utf16"
 
 	"github.com/go-telegram/bot"
 	"github.com/go-telegram/bot/models"
-	"github.com/openai/openai-go"
-	"github.com/openai/openai-go/option"
 	"golang.org/x/exp/slices"
 )
 
 const errorStr = "❌ Error"
 
-var apiClient openai.Client
 var telegramBot *bot.Bot
 
 var cmdHandlers []*cmdHandlerType
 var cmdHandlersMutex sync.Mutex
 
-func uploadImages(ctx context.Context, replyToMsg *models.Message, description string, imgs [][]byte) (msg *models.Message, err error) {
+func uploadImages(ctx context.Context, replyToMsg *models.Message, description string, imgs [][]byte) (msgs []*models.Message, err error) {
 	var media []models.InputMedia
 	for i := range imgs {
 		var c string
@@ -49,13 +49,71 @@ func uploadImages(ctx context.Context, replyToMsg *models.Message, description s
 		MessageThreadID: replyToMsg.MessageThreadID,
 		Media:           media,
 	}
-	_, err = telegramBot.SendMediaGroup(ctx, params)
+	msgs, err = telegramBot.SendMediaGroup(ctx, params)
 	if err != nil {
 		fmt.Println("  send images error:", err)
 	}
 	return
 }
 
+// uploadDocuments sends the given images as documents, so they don't get recompressed.
+func uploadDocuments(ctx context.Context, replyToMsg *models.Message, description string, imgs [][]byte) (msgs []*models.Message, err error) {
+	var media []models.InputMedia
+	for i := range imgs {
+		var c string
+		if i == len(imgs)-1 { // Captions of document groups are shown under the last document.
+			c = truncateText(description, 1024)
+		}
+		ext := "png"
+		if _, format, err := image.DecodeConfig(bytes.NewReader(imgs[i])); err == nil {
+			ext = strings.Replace(format, "jpeg", "jpg", 1)
+		}
+		filename := fmt.Sprintf("imagen-%s-%d.%s", time.Now().Format("250423-213045"), i+1, ext)
+		media = append(media, &models.InputMediaDocument{
+			Media:           "attach://" + filename,
+			MediaAttachment: bytes.NewReader(imgs[i]),
+			Caption:         c,
+		})
+	}
+	params := &bot.SendMediaGroupParams{
+		ChatID:          replyToMsg.Chat.ID,
+		MessageThreadID: replyToMsg.MessageThreadID,
+		Media:           media,
+	}
+	msgs, err = telegramBot.SendMediaGroup(ctx, params)
+	if err != nil {
+		fmt.Println("  send documents error:", err)
+	}
+	return
+}
+
+// getPhotoFileIDs returns the file IDs of the largest photo sizes in the given messages.
+func getPhotoFileIDs(msgs []*models.Message) (fileIDs []string) {
+	for _, msg := range msgs {
+		if msg == nil || len(msg.Photo) == 0 {
+			continue
+		}
+		fileIDs = append(fileIDs, msg.Photo[len(msg.Photo)-1].FileID)
+	}
+	return
+}
+
+// truncateText truncates the text to maxLen UTF-16 code units (as Telegram measures text lengths) on a rune
+// boundary, and appends "..." if it got truncated.
+func truncateText(s string, maxLen int) string {
+	if len(s) <= maxLen || len(utf16.Encode([]rune(s))) <= maxLen { // UTF-8 is never shorter than UTF-16.
+		return s
+	}
+	var n int
+	for i, r := range s {
+		n += utf16.RuneLen(r)
+		if n > maxLen-3 {
+			return s[:i] + "..."
+		}
+	}
+	return s
+}
+
 func sendMessage(ctx context.Context, chatID int64, s string) (msg *models.Message, err error) {
 	msg, err = telegramBot.SendMessage(ctx, &bot.SendMessageParams{
 		ChatID: chatID,
@@ -98,6 +156,21 @@ func sendReplyToMessage(ctx context.Context, replyToMsg *models.Message, s strin
 	return
 }
 
+func sendReplyToMessageWithMarkup(ctx context.Context, replyToMsg *models.Message, s string, markup models.ReplyMarkup) (msg *models.Message, err error) {
+	msg, err = telegramBot.SendMessage(ctx, &bot.SendMessageParams{
+		ReplyParameters: &models.ReplyParameters{
+			MessageID: replyToMsg.ID,
+		},
+		ChatID:      replyToMsg.Chat.ID,
+		Text:        s,
+		ReplyMarkup: markup,
+	})
+	if err != nil {
+		fmt.Println("  reply send error:", err)
+	}
+	return
+}
+
 func sendChatActionTyping(ctx context.Context, chatID int64) {
 	action := bot.SendChatActionParams{
 		ChatID: chatID,
@@ -116,24 +189,6 @@ func sendTextToAdmins(ctx context.Context, s string) {
 	}
 }
 
-func getMimeType(data []byte) (mimeType, extension string) {
-	detectedMimeType := http.DetectContentType(data)
-
-	switch detectedMimeType {
-	case "image/png":
-		extension = ".png"
-	case "image/jpeg":
-		extension = ".jpg"
-	case "image/webp":
-		extension = ".webp"
-	default:
-		detectedMimeType = "application/octet-stream"
-		extension = ".bin"
-	}
-
-	return detectedMimeType, extension
-}
-
 func handleImageMessage(ctx context.Context, msg *models.Message) {
 	var doc *models.Document
 	if msg.Document != nil {
@@ -187,27 +242,72 @@ func handleImageMessage(ctx context.Context, msg *models.Message) {
 		return
 	}
 
-	// Check if the filename already has an extension
-	filename := doc.FileName
-	if len(doc.FileName) == 0 {
-		filename = "image"
+	if cmdHandler.expectRawImages {
+		cmdHandler.expectImageChan <- ImageFilesDataType{Data: d, Filename: doc.FileName, MimeType: doc.MimeType}
+		return
 	}
 
-	mimeType, extension := getMimeType(d)
-	if !strings.Contains(doc.FileName, ".") {
-		// Add appropriate extension based on file content
-		filename += extension
+	img, err := preprocessImage(d, doc.FileName)
+	if err != nil {
+		fmt.Println("  can't process image:", err)
+		_, _ = sendReplyToMessage(ctx, cmdHandler.cmdMsg, errorStr+": "+err.Error())
+		return
 	}
 
-	cmdHandler.expectImageChan <- ImageFilesDataType{
-		Data:     d,
-		Filename: filename,
-		MimeType: mimeType,
+	cmdHandler.expectImageChan <- img
+}
+
+func isAllowed(chatID, fromID int64) bool {
+	if chatID >= 0 { // From user?
+		return slices.Contains(params.AllowedUserIDs, fromID)
+	}
+	return slices.Contains(params.AllowedGroupIDs, chatID)
+}
+
+// addCmdHandler creates and registers a command handler for the given message. The returned function
+// unregisters the handler.
+func addCmdHandler(msg *models.Message) (*cmdHandlerType, func()) {
+	cmdHandler := &cmdHandlerType{
+		cmdMsg: msg,
+	}
+	cmdHandlersMutex.Lock()
+	cmdHandlers = append(cmdHandlers, cmdHandler)
+	cmdHandlersMutex.Unlock()
+
+	return cmdHandler, func() {
+		cmdHandlersMutex.Lock()
+		for i, h := range cmdHandlers {
+			if h == cmdHandler {
+				cmdHandlers = append(cmdHandlers[:i], cmdHandlers[i+1:]...)
+				break
+			}
+		}
+		cmdHandlersMutex.Unlock()
+	}
+}
+
+// checkRateLimit returns false and replies to the message if the sender has reached the rate limit.
+func checkRateLimit(ctx context.Context, msg *models.Message, images int) bool {
+	if err := rateLimiter.Allow(msg.From.ID, msg.Chat.ID, images); err != nil {
+		fmt.Println("  rate limited:", err)
+		_, _ = sendReplyToMessage(ctx, msg, "⏳ "+err.Error())
+		return false
 	}
+	return true
+}
+
+// precheckRateLimit is like checkRateLimit, but it doesn't count the request, as it's counted later.
+func precheckRateLimit(ctx context.Context, msg *models.Message, images int) bool {
+	if err := rateLimiter.Check(msg.From.ID, msg.Chat.ID, images); err != nil {
+		fmt.Println("  rate limited:", err)
+		_, _ = sendReplyToMessage(ctx, msg, "⏳ "+err.Error())
+		return false
+	}
+	return true
 }
 
 func handleMessage(ctx context.Context, update *models.Update) {
-	fmt.Print("msg from ", update.Message.From.Username, "#", update.Message.From.ID, ": ", update.Message.Text, "\n")
+	fmt.Print("msg from ", update.Message.From.Username, "#", update.Message.From.ID, ": ", redactKeyCommand(update.Message.Text), "\n")
 
 	if update.Message.Chat.ID >= 0 { // From user?
 		if !slices.Contains(params.AllowedUserIDs, update.Message.From.ID) {
@@ -223,23 +323,10 @@ func handleMessage(ctx context.Context, update *models.Update) {
 		fmt.Println()
 	}
 
-	cmdHandler := cmdHandlerType{
-		cmdMsg: update.Message,
-	}
-	cmdHandlersMutex.Lock()
-	cmdHandlers = append(cmdHandlers, &cmdHandler)
-	cmdHandlersMutex.Unlock()
+	ctx = customKeys.WithContext(ctx, update.Message.Chat.ID, update.Message.From.ID)
 
-	defer func() {
-		cmdHandlersMutex.Lock()
-		for i, h := range cmdHandlers {
-			if h == &cmdHandler {
-				cmdHandlers = append(cmdHandlers[:i], cmdHandlers[i+1:]...)
-				break
-			}
-		}
-		cmdHandlersMutex.Unlock()
-	}()
+	cmdHandler, removeCmdHandler := addCmdHandler(update.Message)
+	defer removeCmdHandler()
 
 	// Check if message is a command.
 	if update.Message.Text[0] == '/' || update.Message.Text[0] == '!' {
@@ -260,6 +347,62 @@ func handleMessage(ctx context.Context, update *models.Update) {
 			fmt.Println("  interpreting as cmd imagencancel")
 			cmdHandler.Cancel(ctx)
 			return
+		case "imagendescribe":
+			fmt.Println("  interpreting as cmd imagendescribe")
+			if !checkRateLimit(ctx, update.Message, 0) {
+				return
+			}
+			cmdHandler.Describe(ctx)
+			return
+		case "imagenextend":
+			fmt.Println("  interpreting as cmd imagenextend")
+			if !precheckRateLimit(ctx, update.Message, 1) {
+				return
+			}
+			cmdHandler.Extend(ctx)
+			return
+		case "imagennobg":
+			fmt.Println("  interpreting as cmd imagennobg")
+			if !precheckRateLimit(ctx, update.Message, 1) {
+				return
+			}
+			cmdHandler.NoBackground(ctx)
+			return
+		case "imagencrop", "imagenrotate", "imagenflip", "imagenresize", "imagenconvert":
+			fmt.Println("  interpreting as cmd", cmd)
+			if !checkRateLimit(ctx, update.Message, 0) {
+				return
+			}
+			cmdHandler.ImageOp(ctx, cmd)
+			return
+		case "imagenupscale":
+			fmt.Println("  interpreting as cmd imagenupscale")
+			if !checkRateLimit(ctx, update.Message, 0) {
+				return
+			}
+			cmdHandler.Upscale(ctx)
+			return
+		case "imageninfo":
+			fmt.Println("  interpreting as cmd imageninfo")
+			cmdHandler.Info(ctx)
+			return
+		case "imagenkeys":
+			fmt.Println("  interpreting as cmd imagenkeys")
+			if !slices.Contains(params.AdminUserIDs, update.Message.From.ID) {
+				fmt.Println("  user is not an admin")
+				_, _ = sendReplyToMessage(ctx, update.Message, errorStr+": this command is only available for admins")
+				return
+			}
+			_, _ = sendReplyToMessage(ctx, update.Message, "🔑 API keys\n\n"+apiClient.GetStatus())
+			return
+		case "imagenstyle":
+			fmt.Println("  interpreting as cmd imagenstyle")
+			cmdHandler.Style(ctx)
+			return
+		case "imagenkey":
+			fmt.Println("  interpreting as cmd imagenkey")
+			cmdHandler.Key(ctx)
+			return
 		case "imagenhelp":
 			fmt.Println("  interpreting as cmd imagenhelp")
 			cmdHandler.Help(ctx, cmdChar)
@@ -286,6 +429,21 @@ func handleMessage(ctx context.Context, update *models.Update) {
 }
 
 func telegramBotUpdateHandler(ctx context.Context, b *bot.Bot, update *models.Update) {
+	if !jobTracker.Start() {
+		return
+	}
+	defer jobTracker.Done()
+
+	if update.CallbackQuery != nil {
+		callbackHandler.HandleCallbackQuery(ctx, update.CallbackQuery)
+		return
+	}
+
+	if update.InlineQuery != nil {
+		inlineHandler.HandleQuery(ctx, update.InlineQuery)
+		return
+	}
+
 	if update.Message == nil {
 		return
 	}
@@ -305,16 +463,62 @@ func main() {
 		os.Exit(1)
 	}
 
-	apiClient = openai.NewClient(option.WithAPIKey(params.OpenAIAPIKey))
+	if params.ImageModelsFile != "" {
+		if err := loadImageModels(params.ImageModelsFile); err != nil {
+			fmt.Println("error:", err)
+			os.Exit(1)
+		}
+	}
+	if _, err := getImageModel(params.ImageModel); err != nil {
+		fmt.Println("error:", err)
+		os.Exit(1)
+	}
+
+	if params.WatermarkLogo != "" {
+		if err := watermarkHandler.LoadLogo(params.WatermarkLogo); err != nil {
+			fmt.Println("error:", err)
+			os.Exit(1)
+		}
+	}
 
-	var cancel context.CancelFunc
-	ctx, cancel := signal.NotifyContext(context.Background(), os.Interrupt)
+	if params.PromptDenylistFile != "" {
+		if err := moderationHandler.LoadDenylist(params.PromptDenylistFile); err != nil {
+			fmt.Println("error:", err)
+			os.Exit(1)
+		}
+	}
+
+	if err := journal.Init(); err != nil {
+		fmt.Println("error:", err)
+		os.Exit(1)
+	}
+
+	if err := customKeys.Init(); err != nil {
+		fmt.Println("error:", err)
+		os.Exit(1)
+	}
+
+	if err := stylePresets.Init(); err != nil {
+		fmt.Println("error:", err)
+		os.Exit(1)
+	}
+
+	apiClient.Init(params.OpenAIAPIKeys)
+
+	// Receiving updates stops on a signal, but in-flight jobs use a separate context which only gets canceled
+	// when the shutdown grace period expires.
+	signalCtx, signalCancel := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer signalCancel()
+	ctx, cancel := context.WithCancel(context.Background())
 	defer cancel()
 
 	typingHandler.Start(ctx)
+	inlineHandler.Init()
 
 	opts := []bot.Option{
-		bot.WithDefaultHandler(telegramBotUpdateHandler),
+		bot.WithDefaultHandler(func(_ context.Context, b *bot.Bot, update *models.Update) {
+			telegramBotUpdateHandler(ctx, b, update)
+		}),
 	}
 
 	var err error
@@ -323,7 +527,18 @@ func main() {
 		panic(fmt.Sprint("can't init telegram bot: ", err))
 	}
 
+	registerBotCommands(ctx)
+
 	sendTextToAdmins(ctx, "🤖 Bot started")
 
-	telegramBot.Start(ctx)
+	journal.ResumeJobs(ctx)
+
+	botStopped := make(chan struct{})
+	go func() {
+		telegramBot.Start(signalCtx)
+		close(botStopped)
+	}()
+
+	<-signalCtx.Done()
+	shutdown(ctx, cancel, botStopped)
 }
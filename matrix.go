@@ -0,0 +1,150 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// Wildcards are lists of options in braces separated by |, like {red|green|blue}.
+var promptWildcardRegexp = regexp.MustCompile(`\{([^{}]*\|[^{}]*)\}`)
+
+type promptVariantType struct {
+	Prompt string
+	Label  string // The chosen options of the wildcards.
+}
+
+// countPromptVariants returns the number of variants the wildcards of the prompt expand to, or 1 if there
+// are no wildcards. The count is capped to avoid overflows.
+func countPromptVariants(prompt string) int {
+	if params.PromptMatrixMax == 0 {
+		return 1
+	}
+	count := 1
+	for _, match := range promptWildcardRegexp.FindAllStringSubmatch(prompt, -1) {
+		count *= len(strings.Split(match[1], "|"))
+		if count > params.PromptMatrixMax {
+			return params.PromptMatrixMax + 1
+		}
+	}
+	return count
+}
+
+// expandPromptMatrix returns the cartesian product of the wildcard options in the prompt.
+func expandPromptMatrix(prompt string) (variants []promptVariantType) {
+	matches := promptWildcardRegexp.FindAllStringSubmatchIndex(prompt, -1)
+	var options [][]string
+	for _, match := range matches {
+		var o []string
+		for _, s := range strings.Split(prompt[match[2]:match[3]], "|") {
+			o = append(o, strings.TrimSpace(s))
+		}
+		options = append(options, o)
+	}
+
+	// Counting through the combinations, the last wildcard changes the fastest.
+	indexes := make([]int, len(options))
+	for {
+		var p strings.Builder
+		var labels []string
+		pos := 0
+		for i, match := range matches {
+			p.WriteString(prompt[pos:match[0]])
+			p.WriteString(options[i][indexes[i]])
+			pos = match[1]
+			labels = append(labels, options[i][indexes[i]])
+		}
+		p.WriteString(prompt[pos:])
+		variants = append(variants, promptVariantType{
+			Prompt: strings.Join(strings.Fields(p.String()), " "),
+			Label:  strings.Join(labels, " / "),
+		})
+
+		i := len(indexes) - 1
+		for ; i >= 0; i-- {
+			indexes[i]++
+			if indexes[i] < len(options[i]) {
+				break
+			}
+			indexes[i] = 0
+		}
+		if i < 0 {
+			return
+		}
+	}
+}
+
+// ImagenMatrix generates (or edits) images for each prompt variant after the requester confirmed the
+// estimated cost. Variants are run one after the other as separate jobs.
+func (c *cmdHandlerType) ImagenMatrix(ctx context.Context, isEdit bool, imageURLs []string, args imagenArgsType, variants []promptVariantType) {
+	var imgs []ImageFilesDataType
+	if isEdit {
+		var err error
+		if len(imageURLs) > 0 {
+			imgs, err = c.downloadImageURLs(ctx, imageURLs)
+		} else {
+			imgs, err = c.waitForImages(ctx)
+		}
+		if err == nil && len(imgs) == 0 {
+			fmt.Println("    canceled")
+			return
+		}
+		if err != nil {
+			fmt.Println("    error:", err)
+			_, _ = c.reply(ctx, errorStr+": "+err.Error())
+			return
+		}
+	}
+
+	var text strings.Builder
+	fmt.Fprintf(&text, "🔀 Prompt matrix: %d variants × %d images\n\n", len(variants), args.N)
+	var cost float64
+	costs := make([]float64, len(variants))
+	costKnown := true
+	for i, v := range variants {
+		fmt.Fprintf(&text, "%d. %s\n", i+1, v.Label)
+
+		variantArgs := args
+		variantArgs.Prompt = v.Prompt
+		var ok bool
+		costs[i], ok = estimateImagesCost(variantArgs, len(imgs))
+		cost += costs[i]
+		costKnown = costKnown && ok
+	}
+	confirmButtonText := "✅ Confirm"
+	if costKnown {
+		text.WriteString("\n💰 Estimated cost: " + formatCost(cost))
+		confirmButtonText += " (" + formatCost(cost) + ")"
+	} else {
+		text.WriteString("\n💰 Cost estimate is not available for this model")
+	}
+	s := truncateText(text.String(), 4000)
+
+	c.confirm(ctx, s, confirmButtonText, func(ctx context.Context, cmdHandler *cmdHandlerType) {
+		if !checkRateLimit(ctx, cmdHandler.cmdMsg, args.N*len(variants)) {
+			return
+		}
+		for i, v := range variants {
+			if ctx.Err() != nil || !jobTracker.Start() {
+				fmt.Println("    stopping prompt matrix")
+				return
+			}
+			fmt.Println("    running prompt variant", fmt.Sprint(i+1, "/", len(variants)), "prompt:", v.Prompt)
+
+			variantArgs := args
+			variantArgs.Prompt = v.Prompt
+			variantArgs.Variant = fmt.Sprintf("%d/%d: %s", i+1, len(variants), v.Label)
+			if costKnown {
+				variantArgs.EstimatedCost = costs[i]
+			}
+			if isEdit {
+				cmdHandler.ImagenEditImages(ctx, imgs, variantArgs)
+			} else {
+				cmdHandler.ImagenGenerate(ctx, variantArgs)
+			}
+			jobTracker.Done()
+		}
+		_, _ = cmdHandler.reply(ctx, fmt.Sprintf("🔀 Prompt matrix of %d variants finished", len(variants)))
+	})
+}
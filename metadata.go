@@ -0,0 +1,416 @@
+package main
+
+import (
+	"bytes"
+	"compress/zlib"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"html"
+	"image"
+	"io"
+	"regexp"
+	"runtime/debug"
+	"strings"
+	"time"
+
+	"github.com/go-telegram/bot/models"
+	"github.com/openai/openai-go"
+)
+
+const metadataSoftware = "imagen-telegram-bot"
+const xmpHeader = "http://ns.adobe.com/xap/1.0/\x00"
+const xmpNamespace = "https://github.com/nonoo/imagen-telegram-bot/ns/1.0/"
+
+var pngSignature = []byte("\x89PNG\r\n\x1a\n")
+var xmpAttrRegexp = regexp.MustCompile(`imagen:(\w+)="([^"]*)"`)
+
+// Metadata keys in the order they are shown by the info command.
+var metadataKeys = []string{"Prompt", "Model", "Size", "Quality", "Background", "Style", "Generation ID", "Creation Time", "Software"}
+
+// getBotVersion returns the VCS revision the bot was built from.
+func getBotVersion() string {
+	info, ok := debug.ReadBuildInfo()
+	if !ok {
+		return "dev"
+	}
+	for _, s := range info.Settings {
+		if s.Key == "vcs.revision" && len(s.Value) >= 7 {
+			return s.Value[:7]
+		}
+	}
+	return "dev"
+}
+
+// getImageMetadata returns the metadata to be embedded in the generated images. The effective values sent to
+// the API are stored, so the generation can be re-run with the same settings even if the defaults change.
+func getImageMetadata(args imagenArgsType, genID string) map[string]string {
+	m := map[string]string{
+		"Prompt":        args.Prompt,
+		"Model":         args.Model,
+		"Generation ID": genID,
+		"Creation Time": time.Now().UTC().Format(time.RFC3339),
+		"Software":      metadataSoftware + " " + getBotVersion(),
+	}
+	if model, err := getImageModel(args.Model); err == nil {
+		m["Model"] = model.Name
+		m["Size"] = model.supported(model.Sizes, args.Size)
+		m["Quality"] = model.supported(model.Qualities, args.Quality)
+		m["Background"] = model.supported(model.Backgrounds, args.Background)
+		m["Style"] = model.supported(model.Styles, args.Style)
+	}
+	return m
+}
+
+func createPNGChunk(chunkType string, data []byte) []byte {
+	var b bytes.Buffer
+	_ = binary.Write(&b, binary.BigEndian, uint32(len(data)))
+	b.WriteString(chunkType)
+	b.Write(data)
+	_ = binary.Write(&b, binary.BigEndian, crc32.ChecksumIEEE(append([]byte(chunkType), data...)))
+	return b.Bytes()
+}
+
+// addPNGMetadata adds uncompressed iTXt chunks after the IHDR chunk.
+func addPNGMetadata(data []byte, metadata map[string]string) []byte {
+	const ihdrEnd = 8 + 4 + 4 + 13 + 4 // Signature, length, type, data, CRC.
+	if len(data) < ihdrEnd || !bytes.HasPrefix(data, pngSignature) {
+		return data
+	}
+
+	var b bytes.Buffer
+	b.Write(data[:ihdrEnd])
+	for _, k := range metadataKeys {
+		if v := metadata[k]; v != "" {
+			// Keyword, null separator, compression flag and method, empty language tag and translated keyword.
+			b.Write(createPNGChunk("iTXt", []byte(k+"\x00\x00\x00\x00\x00"+v)))
+		}
+	}
+	b.Write(data[ihdrEnd:])
+	return b.Bytes()
+}
+
+// readPNGMetadata returns the contents of the tEXt, zTXt and iTXt chunks.
+func readPNGMetadata(data []byte) map[string]string {
+	m := make(map[string]string)
+	pos := len(pngSignature)
+	for pos+12 <= len(data) {
+		length := int(binary.BigEndian.Uint32(data[pos:]))
+		chunkType := string(data[pos+4 : pos+8])
+		if length < 0 || pos+12+length > len(data) || chunkType == "IDAT" {
+			break
+		}
+		chunk := data[pos+8 : pos+8+length]
+		pos += 12 + length
+
+		keyword, rest, found := bytes.Cut(chunk, []byte{0})
+		if !found {
+			continue
+		}
+		switch chunkType {
+		case "tEXt":
+			m[string(keyword)] = string(rest)
+		case "zTXt":
+			if len(rest) > 0 {
+				if v, err := zlibDecompress(rest[1:]); err == nil {
+					m[string(keyword)] = string(v)
+				}
+			}
+		case "iTXt":
+			if len(rest) < 2 {
+				continue
+			}
+			compressed := rest[0] == 1
+			parts := bytes.SplitN(rest[2:], []byte{0}, 3) // Language tag, translated keyword, text.
+			if len(parts) != 3 {
+				continue
+			}
+			v := parts[2]
+			if compressed {
+				var err error
+				if v, err = zlibDecompress(v); err != nil {
+					continue
+				}
+			}
+			m[string(keyword)] = string(v)
+		}
+	}
+	return m
+}
+
+func zlibDecompress(d []byte) ([]byte, error) {
+	r, err := zlib.NewReader(bytes.NewReader(d))
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+	return io.ReadAll(io.LimitReader(r, 1024*1024))
+}
+
+// getXMPPacket returns the XMP packet containing the given metadata.
+func getXMPPacket(metadata map[string]string) string {
+	var attrs strings.Builder
+	for _, k := range metadataKeys {
+		if v := metadata[k]; v != "" {
+			fmt.Fprintf(&attrs, "\n   imagen:%s=\"%s\"", strings.ReplaceAll(k, " ", ""), html.EscapeString(v))
+		}
+	}
+	return `<?xpacket begin="` + "\ufeff" + `" id="W5M0MpCehiHzreSzNTczkc9d"?>` +
+		`<x:xmpmeta xmlns:x="adobe:ns:meta/"><rdf:RDF xmlns:rdf="http://www.w3.org/1999/02/22-rdf-syntax-ns#">` +
+		`<rdf:Description rdf:about="" xmlns:imagen="` + xmpNamespace + `"` + attrs.String() + `/>` +
+		`</rdf:RDF></x:xmpmeta><?xpacket end="w"?>`
+}
+
+// readXMPPacket adds the imagen attributes of the given XMP packet to the metadata.
+func readXMPPacket(xmp []byte, m map[string]string) {
+	for _, match := range xmpAttrRegexp.FindAllSubmatch(xmp, -1) {
+		// Restoring the spaces of the keys.
+		for _, k := range metadataKeys {
+			if strings.ReplaceAll(k, " ", "") == string(match[1]) {
+				m[k] = html.UnescapeString(string(match[2]))
+			}
+		}
+	}
+}
+
+// addJPEGMetadata adds an XMP APP1 segment after the SOI (and JFIF APP0) segment.
+func addJPEGMetadata(data []byte, metadata map[string]string) []byte {
+	if len(data) < 4 || data[0] != 0xff || data[1] != 0xd8 {
+		return data
+	}
+
+	xmp := xmpHeader + getXMPPacket(metadata)
+	if len(xmp)+2 > 0xffff {
+		return data
+	}
+
+	pos := 2
+	if len(data) > pos+4 && data[pos] == 0xff && data[pos+1] == 0xe0 { // Keeping JFIF APP0 first.
+		pos += 2 + int(binary.BigEndian.Uint16(data[pos+2:]))
+	}
+	if pos > len(data) {
+		return data
+	}
+
+	var b bytes.Buffer
+	b.Write(data[:pos])
+	b.Write([]byte{0xff, 0xe1})
+	_ = binary.Write(&b, binary.BigEndian, uint16(len(xmp)+2))
+	b.WriteString(xmp)
+	b.Write(data[pos:])
+	return b.Bytes()
+}
+
+// readJPEGMetadata returns the imagen attributes of the XMP segment.
+func readJPEGMetadata(data []byte) map[string]string {
+	m := make(map[string]string)
+	pos := 2
+	for pos+4 <= len(data) && data[pos] == 0xff {
+		marker := data[pos+1]
+		segLen := int(binary.BigEndian.Uint16(data[pos+2:]))
+		if marker == 0xda || segLen < 2 || pos+2+segLen > len(data) {
+			break
+		}
+		seg := data[pos+4 : pos+2+segLen]
+		pos += 2 + segLen
+		if marker != 0xe1 || !bytes.HasPrefix(seg, []byte(xmpHeader)) {
+			continue
+		}
+		readXMPPacket(seg, m)
+	}
+	return m
+}
+
+// addWebPMetadata adds an XMP chunk. Files in the simple format (with only the image data chunk) are
+// converted to the extended format, as only that can contain metadata.
+func addWebPMetadata(data []byte, metadata map[string]string) []byte {
+	chunks, ok := parseWebPChunks(data)
+	if !ok || len(chunks) == 0 {
+		return data
+	}
+
+	var res []webpChunkType
+	switch chunks[0].fourCC {
+	case "VP8X":
+		if len(chunks[0].data) < webpVP8XSize {
+			return data
+		}
+		vp8x := bytes.Clone(chunks[0].data)
+		vp8x[0] |= webpFlagXMP
+		res = append(res, webpChunkType{"VP8X", vp8x})
+		for _, c := range chunks[1:] {
+			if c.fourCC != "XMP " {
+				res = append(res, c)
+			}
+		}
+	case "VP8 ", "VP8L":
+		cfg, _, err := image.DecodeConfig(bytes.NewReader(data))
+		if err != nil {
+			return data
+		}
+		// The alpha flag is not set, as lossless images have their own alpha flag, and the x/image/webp
+		// decoder rejects lossless images with the alpha flag set in the VP8X chunk.
+		vp8x := make([]byte, webpVP8XSize)
+		vp8x[0] = webpFlagXMP
+		putUint24LE(vp8x[4:], uint32(cfg.Width-1))
+		putUint24LE(vp8x[7:], uint32(cfg.Height-1))
+		res = append(res, webpChunkType{"VP8X", vp8x})
+		res = append(res, chunks...)
+	default:
+		return data
+	}
+	res = append(res, webpChunkType{"XMP ", []byte(getXMPPacket(metadata))})
+	return webpContainer(res)
+}
+
+// readWebPMetadata returns the imagen attributes of the XMP chunk.
+func readWebPMetadata(data []byte) map[string]string {
+	m := make(map[string]string)
+	chunks, _ := parseWebPChunks(data)
+	for _, c := range chunks {
+		if c.fourCC == "XMP " {
+			readXMPPacket(c.data, m)
+		}
+	}
+	return m
+}
+
+// addImageMetadata embeds the given metadata into the PNG, WebP or JPEG image.
+func addImageMetadata(data []byte, metadata map[string]string) []byte {
+	switch {
+	case bytes.HasPrefix(data, pngSignature):
+		return addPNGMetadata(data, metadata)
+	case isWebP(data):
+		return addWebPMetadata(data, metadata)
+	}
+	return addJPEGMetadata(data, metadata)
+}
+
+// addImagesMetadata embeds the generation params into the given images.
+func addImagesMetadata(imgs [][]byte, args imagenArgsType, genID string) [][]byte {
+	metadata := getImageMetadata(args, genID)
+	res := make([][]byte, len(imgs))
+	for i, d := range imgs {
+		res[i] = addImageMetadata(d, metadata)
+	}
+	return res
+}
+
+// readImageMetadata returns the metadata of the given PNG, WebP or JPEG image.
+func readImageMetadata(data []byte) map[string]string {
+	switch {
+	case bytes.HasPrefix(data, pngSignature):
+		return readPNGMetadata(data)
+	case isWebP(data):
+		return readWebPMetadata(data)
+	}
+	return readJPEGMetadata(data)
+}
+
+func (c *cmdHandlerType) Info(ctx context.Context) {
+	// Metadata would be stripped by preprocessing.
+	c.expectRawImages = true
+	imgs, err := c.waitForImages(ctx)
+	if err == nil && len(imgs) == 0 {
+		fmt.Println("    canceled")
+		return
+	}
+	if err != nil {
+		fmt.Println("    error:", err)
+		_, _ = c.reply(ctx, errorStr+": "+err.Error())
+		return
+	}
+
+	metadata := readImageMetadata(imgs[0].Data)
+	var text strings.Builder
+	for _, k := range metadataKeys {
+		if v := metadata[k]; v != "" {
+			text.WriteString(k + ": " + v + "\n")
+		}
+	}
+	// The invisible watermark survives even if the metadata was removed.
+	if genID := detectInvisibleWatermark(imgs[0].Data); genID != "" {
+		text.WriteString("Invisible watermark: generation ID " + genID + "\n")
+	}
+	if text.Len() == 0 {
+		fmt.Println("    no metadata found")
+		_, _ = c.reply(ctx, "ℹ️ No generation info found in the image. Note that Telegram removes metadata from "+
+			"images sent as photos, so the image should be sent as a file.")
+		return
+	}
+
+	prompt := metadata["Prompt"]
+	if prompt == "" {
+		_, _ = c.reply(ctx, "ℹ️ "+text.String())
+		return
+	}
+
+	// Using the stored settings directly, so nothing in the prompt can be parsed as a flag.
+	args := imagenArgsType{
+		N:          1,
+		Prompt:     prompt,
+		Size:       string(openai.ImageEditParamsSize1024x1024),
+		Background: "opaque",
+		Quality:    "auto",
+	}
+	for _, arg := range []struct {
+		name, key string
+		value     *string
+	}{
+		{"model", "Model", &args.Model}, {"size", "Size", &args.Size}, {"quality", "Quality", &args.Quality},
+		{"background", "Background", &args.Background}, {"style", "Style", &args.Style},
+	} {
+		if v := metadata[arg.key]; v != "" {
+			*arg.value = v
+			args.ArgsPresent = append(args.ArgsPresent, arg.name)
+		}
+	}
+
+	callbackData := callbackHandler.Register(func(ctx context.Context, cq *models.CallbackQuery, msg *models.Message) {
+		fmt.Println("  re-running generation from image info")
+
+		// Using the bot's reply as the command message, so results get posted as a reply to it.
+		genMsg := *msg
+		genMsg.From = &cq.From
+		genMsg.ReplyToMessage = nil
+
+		cmdHandler, removeCmdHandler := addCmdHandler(&genMsg)
+		defer removeCmdHandler()
+		cmdHandler.ImagenRerun(ctx, args)
+	})
+
+	s := truncateText("ℹ️ "+text.String(), 4096)
+	_, _ = sendReplyToMessageWithMarkup(ctx, c.cmdMsg, s,
+		&models.InlineKeyboardMarkup{
+			InlineKeyboard: [][]models.InlineKeyboardButton{
+				{{Text: "🔁 Re-run", CallbackData: callbackData}},
+			},
+		})
+}
+
+// ImagenRerun generates images with the given stored settings.
+func (c *cmdHandlerType) ImagenRerun(ctx context.Context, args imagenArgsType) {
+	if reason := moderationHandler.ScreenPrompt(ctx, c.cmdMsg.From.ID, args.Prompt); reason != "" {
+		fmt.Println("	Prompt rejected:", reason)
+		_, _ = c.reply(ctx, errorStr+": Prompt rejected, "+reason)
+		return
+	}
+
+	m, err := getImageModel(args.Model)
+	if err == nil {
+		err = m.Validate(args, false)
+	}
+	if err != nil {
+		fmt.Println("	Invalid args:", err)
+		_, _ = c.reply(ctx, errorStr+": "+err.Error())
+		return
+	}
+
+	if !precheckRateLimit(ctx, c.cmdMsg, args.N) {
+		return
+	}
+	c.confirmCost(ctx, args, 0, func(ctx context.Context, c *cmdHandlerType, args imagenArgsType) {
+		c.ImagenGenerate(ctx, args)
+	})
+}
@@ -0,0 +1,177 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+
+	"golang.org/x/exp/slices"
+)
+
+// imageModelType describes the capabilities of an image model. Empty lists mean the given param is not
+// supported by the model, so it won't be sent.
+type imageModelType struct {
+	Name          string   `json:"name"`
+	Sizes         []string `json:"sizes"`
+	MaxN          int      `json:"max_n"`
+	MaxEditImages int      `json:"max_edit_images"` // 0 if the model can't edit images.
+	Backgrounds   []string `json:"backgrounds"`
+	Qualities     []string `json:"qualities"`
+	Styles        []string `json:"styles"`
+	Moderation    bool     `json:"moderation"`     // Supports the moderation param.
+	B64Response   bool     `json:"b64_response"`   // Needs response_format=b64_json, otherwise URLs are returned.
+	MaxPromptLen  int      `json:"max_prompt_len"` // 0 if there's no limit.
+
+	SquarePNGInput bool `json:"square_png_input"` // Edit input images and masks have to be square PNGs under 4MB.
+}
+
+// The models file can add new models or override these.
+var imageModels = []imageModelType{
+	{
+		Name:          "gpt-image-1",
+		Sizes:         []string{"1024x1024", "1536x1024", "1024x1536", "auto"},
+		MaxN:          10,
+		MaxEditImages: 16,
+		Backgrounds:   []string{"transparent", "opaque", "auto"},
+		Qualities:     []string{"low", "medium", "high", "auto"},
+		Moderation:    true,
+		MaxPromptLen:  32000,
+	},
+	{
+		Name:         "dall-e-3",
+		Sizes:        []string{"1024x1024", "1792x1024", "1024x1792"},
+		MaxN:         1,
+		Qualities:    []string{"standard", "hd"},
+		Styles:       []string{"vivid", "natural"},
+		B64Response:  true,
+		MaxPromptLen: 4000,
+	},
+	{
+		Name:           "dall-e-2",
+		Sizes:          []string{"256x256", "512x512", "1024x1024"},
+		MaxN:           10,
+		MaxEditImages:  1,
+		B64Response:    true,
+		MaxPromptLen:   1000,
+		SquarePNGInput: true,
+	},
+}
+
+// loadImageModels loads additional model descriptions from the given JSON file, which should contain a list
+// of models.
+func loadImageModels(filename string) error {
+	d, err := os.ReadFile(filename)
+	if err != nil {
+		return fmt.Errorf("can't read image models file: %w", err)
+	}
+	var models []imageModelType
+	if err := json.Unmarshal(d, &models); err != nil {
+		return fmt.Errorf("can't parse image models file: %w", err)
+	}
+
+	for _, m := range models {
+		if m.Name == "" {
+			return fmt.Errorf("image model without name in %s", filename)
+		}
+		if m.MaxN < 1 {
+			m.MaxN = 1
+		}
+		i := slices.IndexFunc(imageModels, func(e imageModelType) bool { return e.Name == m.Name })
+		if i >= 0 {
+			imageModels[i] = m
+		} else {
+			imageModels = append(imageModels, m)
+		}
+	}
+	fmt.Println("loaded", len(models), "image models from", filename)
+	return nil
+}
+
+// getImageModel returns the model with the given name, or the default model if the name is empty.
+func getImageModel(name string) (*imageModelType, error) {
+	if name == "" {
+		name = params.ImageModel
+	}
+	for i := range imageModels {
+		if imageModels[i].Name == name {
+			return &imageModels[i], nil
+		}
+	}
+	return nil, fmt.Errorf("unknown model %s, available models: %s", name, strings.Join(getImageModelNames(), ", "))
+}
+
+func getImageModelNames() (names []string) {
+	for _, m := range imageModels {
+		names = append(names, m.Name)
+	}
+	return
+}
+
+// supported returns the given value if it's in the list of supported values, otherwise an empty string so
+// the param gets omitted from the request.
+func (m *imageModelType) supported(values []string, value string) string {
+	if slices.Contains(values, value) {
+		return value
+	}
+	return ""
+}
+
+func checkSupportedValue(model, argName string, values []string, value string) error {
+	if len(values) == 0 {
+		return fmt.Errorf("model %s doesn't support %s", model, argName)
+	}
+	if !slices.Contains(values, value) {
+		return fmt.Errorf("model %s doesn't support %s %s, supported values: %s", model, argName, value,
+			strings.Join(values, ", "))
+	}
+	return nil
+}
+
+// Validate checks if the explicitly given args are supported by the model.
+func (m *imageModelType) Validate(args imagenArgsType, isEdit bool) error {
+	if isEdit && m.MaxEditImages == 0 {
+		return fmt.Errorf("model %s doesn't support editing images", m.Name)
+	}
+	if m.MaxPromptLen > 0 && len(args.Prompt) > m.MaxPromptLen {
+		return fmt.Errorf("prompt is too long for model %s, max. %d characters", m.Name, m.MaxPromptLen)
+	}
+
+	for _, arg := range args.ArgsPresent {
+		var err error
+		switch arg {
+		case "n":
+			if args.N < 1 || args.N > m.MaxN {
+				err = fmt.Errorf("model %s supports n between 1 and %d", m.Name, m.MaxN)
+			}
+		case "size":
+			err = checkSupportedValue(m.Name, arg, m.Sizes, args.Size)
+		case "background":
+			err = checkSupportedValue(m.Name, arg, m.Backgrounds, args.Background)
+		case "quality":
+			err = checkSupportedValue(m.Name, arg, m.Qualities, args.Quality)
+		case "style":
+			err = checkSupportedValue(m.Name, arg, m.Styles, args.Style)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ValidateEditImages checks if the model can edit the given number of images.
+func (m *imageModelType) ValidateEditImages(count int) error {
+	if count > m.MaxEditImages {
+		return fmt.Errorf("model %s can only edit %d image(s) at once", m.Name, m.MaxEditImages)
+	}
+	return nil
+}
+
+// getResponseFormat returns the response_format param value to be sent to the given model.
+func (m *imageModelType) getResponseFormat() string {
+	if m.B64Response {
+		return "b64_json"
+	}
+	return ""
+}
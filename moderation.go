@@ -0,0 +1,187 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/openai/openai-go/option"
+)
+
+const moderationModel = "omni-moderation-latest"
+
+// Admins get notified if a user's prompts get rejected this many times within the violation window.
+const moderationViolationReportCount = 3
+const moderationViolationWindow = 24 * time.Hour
+
+var moderationLevels = []string{"low", "auto"}
+
+type moderationParams struct {
+	Model string `json:"model"`
+	Input string `json:"input"`
+}
+
+type moderationResponseType struct {
+	Results []struct {
+		Flagged    bool            `json:"flagged"`
+		Categories map[string]bool `json:"categories"`
+	} `json:"results"`
+}
+
+type moderationHandlerType struct {
+	denylist []*regexp.Regexp
+
+	mutex          sync.Mutex
+	violationTimes map[int64][]time.Time // map[UserID]ViolationTimes
+}
+
+var moderationHandler moderationHandlerType
+
+// parseGroupModeration parses the "groupID:level,groupID:level" format.
+func parseGroupModeration(s string) (map[int64]string, error) {
+	res := make(map[int64]string)
+	for _, item := range strings.Split(s, ",") {
+		if item == "" {
+			continue
+		}
+		idStr, level, found := strings.Cut(item, ":")
+		if !found {
+			return nil, fmt.Errorf("group moderation setting has no level: %s", item)
+		}
+		id, err := strconv.ParseInt(idStr, 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("group moderation setting contains invalid group ID: %s", idStr)
+		}
+		if !isValidModerationLevel(level) {
+			return nil, fmt.Errorf("group moderation setting contains invalid level: %s", level)
+		}
+		res[id] = level
+	}
+	return res, nil
+}
+
+func isValidModerationLevel(level string) bool {
+	for _, l := range moderationLevels {
+		if l == level {
+			return true
+		}
+	}
+	return false
+}
+
+// getModerationLevel returns the moderation level to be used for the given chat.
+func getModerationLevel(chatID int64) string {
+	if level, ok := params.GroupModeration[chatID]; ok {
+		return level
+	}
+	return params.Moderation
+}
+
+// LoadDenylist loads the regexp patterns from the given file, one pattern per line. Empty lines and lines
+// starting with # are ignored. Patterns are case insensitive.
+func (m *moderationHandlerType) LoadDenylist(filename string) error {
+	f, err := os.Open(filename)
+	if err != nil {
+		return fmt.Errorf("can't open prompt denylist: %w", err)
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		re, err := regexp.Compile("(?i)" + line)
+		if err != nil {
+			return fmt.Errorf("invalid prompt denylist pattern %s: %w", line, err)
+		}
+		m.denylist = append(m.denylist, re)
+	}
+	return scanner.Err()
+}
+
+func (m *moderationHandlerType) checkModerationEndpoint(ctx context.Context, prompt string) (reason string, err error) {
+	body, err := json.Marshal(moderationParams{
+		Model: moderationModel,
+		Input: prompt,
+	})
+	if err != nil {
+		return "", err
+	}
+
+	var res moderationResponseType
+	err = apiClient.Post(ctx, "moderations", "", body, &res, option.WithHeader("Content-Type", "application/json"))
+	if err != nil {
+		return "", err
+	}
+	if len(res.Results) == 0 || !res.Results[0].Flagged {
+		return "", nil
+	}
+
+	var categories []string
+	for category, flagged := range res.Results[0].Categories {
+		if flagged {
+			categories = append(categories, category)
+		}
+	}
+	sort.Strings(categories)
+	return "flagged by moderation (" + strings.Join(categories, ", ") + ")", nil
+}
+
+// ScreenPrompt checks the prompt against the local denylist and the moderation endpoint (if enabled).
+// Returns the reason if the prompt should be rejected. Rejections are recorded for the given user.
+func (m *moderationHandlerType) ScreenPrompt(ctx context.Context, userID int64, prompt string) (reason string) {
+	for _, re := range m.denylist {
+		if re.MatchString(prompt) {
+			reason = "contains denied content"
+			break
+		}
+	}
+
+	if reason == "" && params.ModerationPreflight {
+		var err error
+		reason, err = m.checkModerationEndpoint(ctx, prompt)
+		if err != nil {
+			// Not blocking the request if the moderation endpoint fails, the image API does moderation anyway.
+			fmt.Println("    moderation check error:", err)
+			return ""
+		}
+	}
+
+	if reason != "" {
+		m.recordViolation(ctx, userID, prompt, reason)
+	}
+	return
+}
+
+func (m *moderationHandlerType) recordViolation(ctx context.Context, userID int64, prompt, reason string) {
+	m.mutex.Lock()
+	if m.violationTimes == nil {
+		m.violationTimes = make(map[int64][]time.Time)
+	}
+	var times []time.Time
+	for _, t := range m.violationTimes[userID] {
+		if time.Since(t) < moderationViolationWindow {
+			times = append(times, t)
+		}
+	}
+	times = append(times, time.Now())
+	m.violationTimes[userID] = times
+	count := len(times)
+	m.mutex.Unlock()
+
+	// Reporting only when the threshold is reached, so admins don't get a report for every later violation.
+	if count == moderationViolationReportCount {
+		sendTextToAdmins(ctx, fmt.Sprint("⚠️ User #", userID, " had ", count, " rejected prompts in the last 24 hours, last one ",
+			reason, ": ", prompt))
+	}
+}
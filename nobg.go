@@ -0,0 +1,79 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"image"
+	"strings"
+
+	"golang.org/x/exp/slices"
+)
+
+const removeBgPrompt = "Remove the background completely, keep only the main subject unchanged with clean, precise edges. " +
+	"The background must be fully transparent."
+
+// hasTransparency returns true if the given image data has at least one non-opaque pixel.
+func hasTransparency(data []byte) bool {
+	img, _, err := image.Decode(bytes.NewReader(data))
+	if err != nil {
+		return false
+	}
+	if o, ok := img.(interface{ Opaque() bool }); ok {
+		return !o.Opaque()
+	}
+	b := img.Bounds()
+	for y := b.Min.Y; y < b.Max.Y; y++ {
+		for x := b.Min.X; x < b.Max.X; x++ {
+			if _, _, _, a := img.At(x, y).RGBA(); a < 0xffff {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func (c *cmdHandlerType) NoBackground(ctx context.Context) {
+	var model string
+	words := strings.Fields(c.cmdMsg.Text)
+	if len(words) == 2 && words[0] == "-model" {
+		model = words[1]
+	} else if len(words) > 0 {
+		fmt.Println("	Invalid args:", c.cmdMsg.Text)
+		_, _ = c.reply(ctx, errorStr+": Invalid args, only -model can be given")
+		return
+	}
+
+	m, err := getImageModel(model)
+	if err == nil && !slices.Contains(m.Backgrounds, "transparent") {
+		err = fmt.Errorf("model %s doesn't support transparent backgrounds", m.Name)
+	}
+	if err != nil {
+		fmt.Println("	Invalid args:", err)
+		_, _ = c.reply(ctx, errorStr+": "+err.Error())
+		return
+	}
+
+	imgs, err := c.waitForImages(ctx)
+	if err == nil && len(imgs) == 0 {
+		fmt.Println("    canceled")
+		return
+	}
+	if err != nil {
+		fmt.Println("    error:", err)
+		_, _ = c.reply(ctx, errorStr+": "+err.Error())
+		return
+	}
+
+	args := imagenArgsType{
+		ArgsPresent: []string{"background"},
+		N:           1,
+		Prompt:      removeBgPrompt,
+		Model:       model,
+		Background:  "transparent",
+		RemoveBg:    true,
+	}
+	c.confirmCost(ctx, args, 1, func(ctx context.Context, c *cmdHandlerType, args imagenArgsType) {
+		c.ImagenEditImages(ctx, imgs[:1], args)
+	})
+}
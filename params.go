@@ -3,26 +3,124 @@ package main
 import (
 	"flag"
 	"fmt"
+	"net/url"
 	"os"
 	"strconv"
 	"strings"
+	"time"
 
 	"golang.org/x/exp/slices"
 )
 
 type paramsType struct {
-	OpenAIAPIKey string
-	BotToken     string
+	OpenAIAPIKey       string
+	OpenAIAPIKeys      []apiKeyConfigType
+	OpenAIKeySelection string
+	OpenAIBaseURL      string
+	OpenAIHeaders      map[string]string
+	OpenAIProxy        *url.URL
+	AzureAPIVersion    string
+	ImageModel         string
+	ImageModelsFile    string
+	UpscalerCmd        string
+	GridWithAlbum      bool
+	PromptMatrixMax    int
+	Watermark          string
+	ChatWatermark      map[int64]string // map[ChatID]WatermarkMode
+	WatermarkText      string
+	WatermarkLogo      string
+	WatermarkPosition  string
+	WatermarkOpacity   int
+	KeyEncryptionKey   string
+	CustomKeyFallback  string
+	BotToken           string
 
 	AllowedUserIDs  []int64
 	AdminUserIDs    []int64
 	AllowedGroupIDs []int64
+
+	BotDescription      string
+	BotShortDescription string
+
+	VisionModel string
+
+	Moderation          string
+	GroupModeration     map[int64]string // map[GroupID]ModerationLevel
+	ModerationPreflight bool
+	PromptDenylistFile  string
+
+	InlineStorageChatID    int64
+	InlineMaxImagesPerHour int
+
+	ArchiveChatID          int64
+	ArchiveExcludeGroupIDs []int64
+	ArchiveSkipPrivate     bool
+
+	SendOriginalsChatIDs []int64
+
+	UserRequestsPerMinute  int
+	UserImagesPerHour      int
+	GroupRequestsPerMinute int
+	GroupImagesPerHour     int
+
+	ConfirmCostThreshold float64
+
+	ShutdownGracePeriod time.Duration
+
+	DataDir              string
+	InterruptedJobMode   string
+	InterruptedJobMaxAge time.Duration
 }
 
 var params paramsType
 
+// parseIntParam returns the given value, or the value of the given env var if it's empty, or the default
+// value if both are empty.
+func parseIntParam(value, envName string, defaultValue int) (int, error) {
+	if value == "" {
+		value = os.Getenv(envName)
+	}
+	if value == "" {
+		return defaultValue, nil
+	}
+	i, err := strconv.Atoi(value)
+	if err != nil || i < 0 {
+		return 0, fmt.Errorf("invalid %s value: %s", strings.ToLower(envName), value)
+	}
+	return i, nil
+}
+
 func (p *paramsType) Init() error {
 	flag.StringVar(&p.OpenAIAPIKey, "openai-api-key", "", "openai api key")
+	var openAIAPIKeys string
+	flag.StringVar(&openAIAPIKeys, "openai-api-keys", "", "openai api keys in key:organization:project format (organization and project are optional), separated by commas")
+	flag.StringVar(&p.OpenAIKeySelection, "openai-key-selection", "", "openai api key selection: round-robin or least-spend (default round-robin)")
+	flag.StringVar(&p.OpenAIBaseURL, "openai-base-url", "", "openai api base url, or the endpoint in azure mode")
+	var openAIHeaders string
+	flag.StringVar(&openAIHeaders, "openai-headers", "", "custom headers sent to the openai api in name:value format, separated by commas")
+	var openAIProxy string
+	flag.StringVar(&openAIProxy, "openai-proxy", "", "proxy url used for the openai api")
+	flag.StringVar(&p.AzureAPIVersion, "azure-api-version", "", "azure openai api version, enables azure mode")
+	flag.StringVar(&p.ImageModel, "image-model", "", "default image model name, or deployment name in azure mode (default gpt-image-1)")
+	flag.StringVar(&p.Watermark, "watermark", "", "watermark mode: off, visible, invisible or both (default off)")
+	var chatWatermark string
+	flag.StringVar(&chatWatermark, "chat-watermark", "", "per chat watermark modes in chatID:mode format, separated by commas")
+	flag.StringVar(&p.WatermarkText, "watermark-text", "", "text of the visible watermark (default AI generated)")
+	flag.StringVar(&p.WatermarkLogo, "watermark-logo", "", "image file used as logo in the visible watermark")
+	flag.StringVar(&p.WatermarkPosition, "watermark-position", "", "position of the visible watermark (default bottom-right)")
+	var watermarkOpacity string
+	flag.StringVar(&watermarkOpacity, "watermark-opacity", "", "opacity of the visible watermark in percent (default 50)")
+	flag.BoolVar(&p.GridWithAlbum, "grid-with-album", false, "send the album of the images after the grid in grid mode")
+	var sendOriginalsChatIDs string
+	flag.StringVar(&sendOriginalsChatIDs, "send-originals-chat-ids", "", "chat ids where the generated images are also sent as documents, keeping their metadata")
+	var confirmCostThreshold string
+	flag.StringVar(&confirmCostThreshold, "confirm-cost-threshold", "", "estimated cost in USD above which requests need to be confirmed, 0 means never (default 0)")
+	var promptMatrixMax string
+	flag.StringVar(&promptMatrixMax, "prompt-matrix-max", "", "max. number of prompt variants of wildcard prompts, 0 disables wildcards (default 16)")
+	flag.StringVar(&p.UpscalerCmd, "upscaler-cmd", "", "external upscaler command, used instead of the built-in upscaler")
+	flag.StringVar(&p.ImageModelsFile, "image-models-file", "", "json file describing additional image models and their capabilities")
+	flag.StringVar(&p.KeyEncryptionKey, "key-encryption-key", "", "master key for encrypting user and group api keys, custom keys are disabled if not set")
+	flag.StringVar(&p.CustomKeyFallback, "custom-key-fallback", "", "operator key usage with custom keys: operator, none or require (default operator)")
 	flag.StringVar(&p.BotToken, "bot-token", "", "telegram bot token")
 	var allowedUserIDs string
 	flag.StringVar(&allowedUserIDs, "allowed-user-ids", "", "allowed telegram user ids")
@@ -30,15 +128,203 @@ func (p *paramsType) Init() error {
 	flag.StringVar(&adminUserIDs, "admin-user-ids", "", "admin telegram user ids")
 	var allowedGroupIDs string
 	flag.StringVar(&allowedGroupIDs, "allowed-group-ids", "", "allowed telegram group ids")
+	flag.StringVar(&p.BotDescription, "bot-description", "", "bot description shown in empty chats with the bot")
+	flag.StringVar(&p.BotShortDescription, "bot-short-description", "", "bot short description shown on the bot's profile page")
+	flag.StringVar(&p.VisionModel, "vision-model", "", "vision capable chat model used for describing images (default gpt-4.1-mini)")
+	flag.StringVar(&p.Moderation, "moderation", "", "moderation level: low or auto (default low)")
+	var groupModeration string
+	flag.StringVar(&groupModeration, "group-moderation", "", "per group moderation levels in groupID:level format, separated by commas")
+	flag.BoolVar(&p.ModerationPreflight, "moderation-preflight", false, "check prompts with the moderation endpoint before generating")
+	flag.StringVar(&p.PromptDenylistFile, "prompt-denylist-file", "", "file containing denied prompt regexp patterns, one per line")
+	var inlineStorageChatID string
+	flag.StringVar(&inlineStorageChatID, "inline-storage-chat-id", "", "chat id where inline mode results are uploaded (the user's private chat if not set), and where grid mode images are stored")
+	var inlineMaxImagesPerHour string
+	flag.StringVar(&inlineMaxImagesPerHour, "inline-max-images-per-hour", "", "max. inline mode generations per user per hour, 0 means unlimited (default 10)")
+	var archiveChatID string
+	flag.StringVar(&archiveChatID, "archive-chat-id", "", "chat id where all generated images are mirrored")
+	var archiveExcludeGroupIDs string
+	flag.StringVar(&archiveExcludeGroupIDs, "archive-exclude-group-ids", "", "group ids whose generations are not mirrored to the archive chat")
+	flag.BoolVar(&p.ArchiveSkipPrivate, "archive-skip-private", false, "don't mirror generations of private chats to the archive chat")
+	var userRequestsPerMinute string
+	flag.StringVar(&userRequestsPerMinute, "user-requests-per-minute", "", "max. requests per user per minute, 0 means unlimited")
+	var userImagesPerHour string
+	flag.StringVar(&userImagesPerHour, "user-images-per-hour", "", "max. generated images per user per hour, 0 means unlimited")
+	var groupRequestsPerMinute string
+	flag.StringVar(&groupRequestsPerMinute, "group-requests-per-minute", "", "max. requests per group per minute, 0 means unlimited")
+	var groupImagesPerHour string
+	flag.StringVar(&groupImagesPerHour, "group-images-per-hour", "", "max. generated images per group per hour, 0 means unlimited")
+	var shutdownGracePeriod string
+	flag.StringVar(&shutdownGracePeriod, "shutdown-grace-period", "", "seconds to wait for in-flight jobs to finish on shutdown (default 120)")
+	flag.StringVar(&p.DataDir, "data-dir", "", "directory where the bot stores its data (default data)")
+	flag.StringVar(&p.InterruptedJobMode, "interrupted-job-mode", "", "what to do with jobs interrupted by a restart: rerun, notify or off (default rerun)")
+	var interruptedJobMaxAge string
+	flag.StringVar(&interruptedJobMaxAge, "interrupted-job-max-age", "", "interrupted jobs older than this many minutes are skipped (default 60)")
 	flag.Parse()
 
 	if p.OpenAIAPIKey == "" {
 		p.OpenAIAPIKey = os.Getenv("OPENAI_API_KEY")
 	}
-	if p.OpenAIAPIKey == "" {
+	if openAIAPIKeys == "" {
+		openAIAPIKeys = os.Getenv("OPENAI_API_KEYS")
+	}
+	var err error
+	if p.OpenAIAPIKeys, err = parseAPIKeys(openAIAPIKeys); err != nil {
+		return err
+	}
+	if p.OpenAIAPIKey != "" {
+		p.OpenAIAPIKeys = append([]apiKeyConfigType{{Key: p.OpenAIAPIKey}}, p.OpenAIAPIKeys...)
+	}
+	if len(p.OpenAIAPIKeys) == 0 {
 		return fmt.Errorf("openai api key not set")
 	}
 
+	if p.OpenAIKeySelection == "" {
+		p.OpenAIKeySelection = os.Getenv("OPENAI_KEY_SELECTION")
+	}
+	switch p.OpenAIKeySelection {
+	case "":
+		p.OpenAIKeySelection = keySelectionRoundRobin
+	case keySelectionRoundRobin, keySelectionLeastSpend:
+	default:
+		return fmt.Errorf("invalid openai key selection: %s", p.OpenAIKeySelection)
+	}
+
+	if p.OpenAIBaseURL == "" {
+		p.OpenAIBaseURL = os.Getenv("OPENAI_BASE_URL")
+	}
+
+	if openAIHeaders == "" {
+		openAIHeaders = os.Getenv("OPENAI_HEADERS")
+	}
+	if p.OpenAIHeaders, err = parseHeaders(openAIHeaders); err != nil {
+		return err
+	}
+
+	if openAIProxy == "" {
+		openAIProxy = os.Getenv("OPENAI_PROXY")
+	}
+	if openAIProxy != "" {
+		if p.OpenAIProxy, err = url.Parse(openAIProxy); err != nil {
+			return fmt.Errorf("invalid openai proxy url: %s", openAIProxy)
+		}
+	}
+
+	if p.AzureAPIVersion == "" {
+		p.AzureAPIVersion = os.Getenv("AZURE_API_VERSION")
+	}
+	if p.AzureAPIVersion != "" && p.OpenAIBaseURL == "" {
+		return fmt.Errorf("openai base url has to be set to the azure endpoint in azure mode")
+	}
+
+	if p.ImageModel == "" {
+		p.ImageModel = os.Getenv("IMAGE_MODEL")
+	}
+	if p.ImageModel == "" {
+		p.ImageModel = "gpt-image-1"
+	}
+
+	if p.ImageModelsFile == "" {
+		p.ImageModelsFile = os.Getenv("IMAGE_MODELS_FILE")
+	}
+
+	if p.UpscalerCmd == "" {
+		p.UpscalerCmd = os.Getenv("UPSCALER_CMD")
+	}
+
+	if p.Watermark == "" {
+		p.Watermark = os.Getenv("WATERMARK")
+	}
+	if p.Watermark == "" {
+		p.Watermark = watermarkOff
+	}
+	if !isValidWatermarkMode(p.Watermark) {
+		return fmt.Errorf("invalid watermark mode: %s", p.Watermark)
+	}
+
+	if chatWatermark == "" {
+		chatWatermark = os.Getenv("CHAT_WATERMARK")
+	}
+	if p.ChatWatermark, err = parseChatWatermark(chatWatermark); err != nil {
+		return err
+	}
+
+	if p.WatermarkText == "" {
+		p.WatermarkText = os.Getenv("WATERMARK_TEXT")
+	}
+	if p.WatermarkText == "" {
+		p.WatermarkText = "AI generated"
+	}
+
+	if p.WatermarkLogo == "" {
+		p.WatermarkLogo = os.Getenv("WATERMARK_LOGO")
+	}
+
+	if p.WatermarkPosition == "" {
+		p.WatermarkPosition = os.Getenv("WATERMARK_POSITION")
+	}
+	if p.WatermarkPosition == "" {
+		p.WatermarkPosition = "bottom-right"
+	}
+	if !slices.Contains(watermarkPositions, p.WatermarkPosition) {
+		return fmt.Errorf("invalid watermark position: %s", p.WatermarkPosition)
+	}
+
+	if p.WatermarkOpacity, err = parseIntParam(watermarkOpacity, "WATERMARK_OPACITY", 50); err != nil {
+		return err
+	}
+	if p.WatermarkOpacity > 100 {
+		return fmt.Errorf("invalid watermark opacity: %d", p.WatermarkOpacity)
+	}
+
+	if !p.GridWithAlbum && os.Getenv("GRID_WITH_ALBUM") != "" {
+		p.GridWithAlbum, err = strconv.ParseBool(os.Getenv("GRID_WITH_ALBUM"))
+		if err != nil {
+			return fmt.Errorf("invalid grid with album setting: %s", os.Getenv("GRID_WITH_ALBUM"))
+		}
+	}
+	if sendOriginalsChatIDs == "" {
+		sendOriginalsChatIDs = os.Getenv("SEND_ORIGINALS_CHATIDS")
+	}
+	for _, idStr := range strings.Split(sendOriginalsChatIDs, ",") {
+		if idStr == "" {
+			continue
+		}
+		id, err := strconv.ParseInt(idStr, 10, 64)
+		if err != nil {
+			return fmt.Errorf("send originals chat ids contains invalid chat ID: %s", idStr)
+		}
+		p.SendOriginalsChatIDs = append(p.SendOriginalsChatIDs, id)
+	}
+
+	if confirmCostThreshold == "" {
+		confirmCostThreshold = os.Getenv("CONFIRM_COST_THRESHOLD")
+	}
+	if confirmCostThreshold != "" {
+		p.ConfirmCostThreshold, err = strconv.ParseFloat(confirmCostThreshold, 64)
+		if err != nil || p.ConfirmCostThreshold < 0 {
+			return fmt.Errorf("invalid confirm cost threshold: %s", confirmCostThreshold)
+		}
+	}
+
+	if p.PromptMatrixMax, err = parseIntParam(promptMatrixMax, "PROMPT_MATRIX_MAX", 16); err != nil {
+		return err
+	}
+
+	if p.KeyEncryptionKey == "" {
+		p.KeyEncryptionKey = os.Getenv("KEY_ENCRYPTION_KEY")
+	}
+
+	if p.CustomKeyFallback == "" {
+		p.CustomKeyFallback = os.Getenv("CUSTOM_KEY_FALLBACK")
+	}
+	switch p.CustomKeyFallback {
+	case "":
+		p.CustomKeyFallback = customKeyFallbackOperator
+	case customKeyFallbackOperator, customKeyFallbackNone, customKeyFallbackRequire:
+	default:
+		return fmt.Errorf("invalid custom key fallback: %s", p.CustomKeyFallback)
+	}
+
 	if p.BotToken == "" {
 		p.BotToken = os.Getenv("BOT_TOKEN")
 	}
@@ -94,5 +380,134 @@ func (p *paramsType) Init() error {
 		p.AllowedGroupIDs = append(p.AllowedGroupIDs, id)
 	}
 
+	if p.BotDescription == "" {
+		p.BotDescription = os.Getenv("BOT_DESCRIPTION")
+	}
+	if p.BotShortDescription == "" {
+		p.BotShortDescription = os.Getenv("BOT_SHORT_DESCRIPTION")
+	}
+
+	if p.VisionModel == "" {
+		p.VisionModel = os.Getenv("VISION_MODEL")
+	}
+	if p.VisionModel == "" {
+		p.VisionModel = "gpt-4.1-mini"
+	}
+
+	if p.Moderation == "" {
+		p.Moderation = os.Getenv("MODERATION")
+	}
+	if p.Moderation == "" {
+		p.Moderation = "low"
+	}
+	if !isValidModerationLevel(p.Moderation) {
+		return fmt.Errorf("invalid moderation level: %s", p.Moderation)
+	}
+
+	if groupModeration == "" {
+		groupModeration = os.Getenv("GROUP_MODERATION")
+	}
+	p.GroupModeration, err = parseGroupModeration(groupModeration)
+	if err != nil {
+		return err
+	}
+
+	if !p.ModerationPreflight && os.Getenv("MODERATION_PREFLIGHT") != "" {
+		p.ModerationPreflight, err = strconv.ParseBool(os.Getenv("MODERATION_PREFLIGHT"))
+		if err != nil {
+			return fmt.Errorf("invalid moderation preflight setting: %s", os.Getenv("MODERATION_PREFLIGHT"))
+		}
+	}
+	if p.ModerationPreflight && p.AzureAPIVersion != "" {
+		return fmt.Errorf("moderation preflight is not available in azure mode")
+	}
+
+	if p.PromptDenylistFile == "" {
+		p.PromptDenylistFile = os.Getenv("PROMPT_DENYLIST_FILE")
+	}
+
+	if inlineStorageChatID == "" {
+		inlineStorageChatID = os.Getenv("INLINE_STORAGE_CHATID")
+	}
+	if inlineStorageChatID != "" {
+		p.InlineStorageChatID, err = strconv.ParseInt(inlineStorageChatID, 10, 64)
+		if err != nil {
+			return fmt.Errorf("invalid inline storage chat ID: %s", inlineStorageChatID)
+		}
+	}
+
+	if p.InlineMaxImagesPerHour, err = parseIntParam(inlineMaxImagesPerHour, "INLINE_MAX_IMAGES_PER_HOUR", 10); err != nil {
+		return err
+	}
+
+	if archiveChatID == "" {
+		archiveChatID = os.Getenv("ARCHIVE_CHATID")
+	}
+	if archiveChatID != "" {
+		p.ArchiveChatID, err = strconv.ParseInt(archiveChatID, 10, 64)
+		if err != nil {
+			return fmt.Errorf("invalid archive chat ID: %s", archiveChatID)
+		}
+	}
+	if archiveExcludeGroupIDs == "" {
+		archiveExcludeGroupIDs = os.Getenv("ARCHIVE_EXCLUDE_GROUPIDS")
+	}
+	sa = strings.Split(archiveExcludeGroupIDs, ",")
+	for _, idStr := range sa {
+		if idStr == "" {
+			continue
+		}
+		id, err := strconv.ParseInt(idStr, 10, 64)
+		if err != nil {
+			return fmt.Errorf("archive exclude group ids contains invalid group ID: %s", idStr)
+		}
+		p.ArchiveExcludeGroupIDs = append(p.ArchiveExcludeGroupIDs, id)
+	}
+	if !p.ArchiveSkipPrivate && os.Getenv("ARCHIVE_SKIP_PRIVATE") != "" {
+		p.ArchiveSkipPrivate, err = strconv.ParseBool(os.Getenv("ARCHIVE_SKIP_PRIVATE"))
+		if err != nil {
+			return fmt.Errorf("invalid archive skip private setting: %s", os.Getenv("ARCHIVE_SKIP_PRIVATE"))
+		}
+	}
+
+	if p.UserRequestsPerMinute, err = parseIntParam(userRequestsPerMinute, "USER_REQUESTS_PER_MINUTE", 0); err != nil {
+		return err
+	}
+	if p.UserImagesPerHour, err = parseIntParam(userImagesPerHour, "USER_IMAGES_PER_HOUR", 0); err != nil {
+		return err
+	}
+	if p.GroupRequestsPerMinute, err = parseIntParam(groupRequestsPerMinute, "GROUP_REQUESTS_PER_MINUTE", 0); err != nil {
+		return err
+	}
+	if p.GroupImagesPerHour, err = parseIntParam(groupImagesPerHour, "GROUP_IMAGES_PER_HOUR", 0); err != nil {
+		return err
+	}
+
+	gracePeriodSec, err := parseIntParam(shutdownGracePeriod, "SHUTDOWN_GRACE_PERIOD", 120)
+	if err != nil {
+		return err
+	}
+	p.ShutdownGracePeriod = time.Duration(gracePeriodSec) * time.Second
+
+	if p.DataDir == "" {
+		p.DataDir = os.Getenv("DATA_DIR")
+	}
+	if p.DataDir == "" {
+		p.DataDir = "data"
+	}
+
+	if p.InterruptedJobMode == "" {
+		p.InterruptedJobMode = os.Getenv("INTERRUPTED_JOB_MODE")
+	}
+	if p.InterruptedJobMode, err = parseInterruptedJobMode(p.InterruptedJobMode); err != nil {
+		return err
+	}
+
+	maxAgeMin, err := parseIntParam(interruptedJobMaxAge, "INTERRUPTED_JOB_MAX_AGE", 60)
+	if err != nil {
+		return err
+	}
+	p.InterruptedJobMaxAge = time.Duration(maxAgeMin) * time.Minute
+
 	return nil
 }
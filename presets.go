@@ -0,0 +1,344 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+
+	"golang.org/x/exp/slices"
+)
+
+const stylePresetPromptPlaceholder = "{prompt}"
+const maxStylePresetsPerOwner = 50
+
+var stylePresetNameRegexp = regexp.MustCompile(`^[a-z0-9_-]{1,32}$`)
+
+// Flags which can be set by style presets. Flags in the list take a value.
+var stylePresetValueFlags = []string{"n", "model", "size", "background", "quality", "style", "upscale", "ar"}
+var stylePresetBoolFlags = []string{"square", "portrait", "landscape", "exact", "sharpen", "grid"}
+
+// stylePresetType is a named prompt template with default flags. If the template contains the {prompt}
+// placeholder, it gets replaced with the prompt, otherwise the template is appended to the prompt.
+type stylePresetType struct {
+	Template string
+	Flags    string `json:",omitempty"`
+}
+
+// apply returns the prompt with the preset's template applied.
+func (s *stylePresetType) apply(prompt string) string {
+	if strings.Contains(s.Template, stylePresetPromptPlaceholder) {
+		return strings.ReplaceAll(s.Template, stylePresetPromptPlaceholder, prompt)
+	}
+	return strings.TrimRight(prompt, " ,.") + ", " + s.Template
+}
+
+func (s *stylePresetType) String() string {
+	if s.Flags == "" {
+		return s.Template
+	}
+	return s.Flags + " " + s.Template
+}
+
+var builtinStylePresets = map[string]stylePresetType{
+	"photo":      {Template: "professional photograph, natural lighting, shallow depth of field, high detail"},
+	"cinematic":  {Template: "cinematic film still, dramatic lighting, anamorphic lens, color graded", Flags: "-landscape"},
+	"anime":      {Template: "anime style illustration, clean line art, vibrant cel shading"},
+	"watercolor": {Template: "watercolor painting, soft washes, visible paper texture"},
+	"sketch":     {Template: "pencil sketch, hand drawn, cross hatching, monochrome"},
+	"pixelart":   {Template: "pixel art, 16-bit retro video game style, limited palette"},
+	"3d":         {Template: "3D render, soft studio lighting, octane render, high detail"},
+	"flat":       {Template: "flat vector illustration, simple shapes, solid colors, white background"},
+	"sticker":    {Template: "die-cut sticker of {prompt}, bold outline, vibrant colors", Flags: "-square -background transparent"},
+	"logo":       {Template: "minimalist logo of {prompt}, vector, simple, centered", Flags: "-square"},
+}
+
+// Style presets are stored for users and groups separately. Group presets are available for everyone in
+// the group, user presets are available in all chats.
+type stylePresetsType struct {
+	mutex    sync.Mutex
+	filename string
+	presets  map[string]map[string]stylePresetType // map[Owner]map[Name]Preset, owner is "user:ID" or "group:ID"
+}
+
+var stylePresets stylePresetsType
+
+func (s *stylePresetsType) Init() error {
+	s.presets = make(map[string]map[string]stylePresetType)
+	s.filename = filepath.Join(params.DataDir, "stylepresets.json")
+	d, err := os.ReadFile(s.filename)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return fmt.Errorf("can't read style presets: %w", err)
+	}
+	if err := json.Unmarshal(d, &s.presets); err != nil {
+		return fmt.Errorf("can't parse style presets: %w", err)
+	}
+	return nil
+}
+
+// save should be called with the mutex locked.
+func (s *stylePresetsType) save() error {
+	d, err := json.Marshal(s.presets)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(s.filename), 0700); err != nil {
+		return err
+	}
+	return os.WriteFile(s.filename, d, 0600)
+}
+
+func (s *stylePresetsType) Set(owner, name string, preset stylePresetType) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if s.presets[owner] == nil {
+		s.presets[owner] = make(map[string]stylePresetType)
+	}
+	if _, ok := s.presets[owner][name]; !ok && len(s.presets[owner]) >= maxStylePresetsPerOwner {
+		return fmt.Errorf("max. %d style presets can be stored", maxStylePresetsPerOwner)
+	}
+	s.presets[owner][name] = preset
+	return s.save()
+}
+
+func (s *stylePresetsType) Remove(owner, name string) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if _, ok := s.presets[owner][name]; !ok {
+		return fmt.Errorf("style preset %s not found", name)
+	}
+	delete(s.presets[owner], name)
+	if len(s.presets[owner]) == 0 {
+		delete(s.presets, owner)
+	}
+	return s.save()
+}
+
+// Get returns the preset with the given name. Group presets take precedence over user presets, and user
+// presets over the built-in ones. Returns nil if there's no preset with the given name.
+func (s *stylePresetsType) Get(chatID, userID int64, name string) *stylePresetType {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	var owners []string
+	if chatID < 0 {
+		owners = append(owners, getCustomKeyOwner(chatID, userID))
+	}
+	owners = append(owners, getCustomKeyOwner(0, userID))
+	for _, owner := range owners {
+		if p, ok := s.presets[owner][name]; ok {
+			return &p
+		}
+	}
+	if p, ok := builtinStylePresets[name]; ok {
+		return &p
+	}
+	return nil
+}
+
+// List returns the presets of the given owner sorted by name.
+func (s *stylePresetsType) List(owner string) (names []string, presets []stylePresetType) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	for name := range s.presets[owner] {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		presets = append(presets, s.presets[owner][name])
+	}
+	return
+}
+
+// isModelStyle returns true if the given value is a style supported by one of the image models.
+func isModelStyle(value string) bool {
+	for _, m := range imageModels {
+		if slices.Contains(m.Styles, value) {
+			return true
+		}
+	}
+	return false
+}
+
+// applyStylePresetFlags replaces the -style flag referring to a preset with the preset's default flags. The
+// default flags are placed before the other words, so flags given in the command override them.
+func applyStylePresetFlags(words []string, chatID, userID int64) (res []string, name string, preset *stylePresetType) {
+	for i := 0; i < len(words); i++ {
+		if words[i] != "-style" || i+1 >= len(words) || isModelStyle(words[i+1]) {
+			continue
+		}
+		if preset = stylePresets.Get(chatID, userID, words[i+1]); preset == nil {
+			continue
+		}
+		name = words[i+1]
+		res = append(strings.Fields(preset.Flags), words[:i]...)
+		res = append(res, words[i+2:]...)
+		return res, name, preset
+	}
+	return words, "", nil
+}
+
+// validateStylePresetFlags checks if the given flags can be used in a style preset.
+func validateStylePresetFlags(flags []string) error {
+	for i := 0; i < len(flags); i++ {
+		argName := strings.TrimPrefix(flags[i], "-")
+		switch {
+		case !strings.HasPrefix(flags[i], "-"):
+			return fmt.Errorf("invalid flag: %s", flags[i])
+		case slices.Contains(stylePresetBoolFlags, argName):
+		case slices.Contains(stylePresetValueFlags, argName):
+			if i+1 >= len(flags) || strings.HasPrefix(flags[i+1], "-") {
+				return fmt.Errorf("missing value for flag: %s", argName)
+			}
+			if argName == "style" && !isModelStyle(flags[i+1]) {
+				return fmt.Errorf("style presets can't refer to other presets")
+			}
+			i++
+		default:
+			return fmt.Errorf("flag %s can't be used in style presets", argName)
+		}
+	}
+	return nil
+}
+
+// parseStylePresetAdd parses the "name (flags) "template"" format. Quotes are optional, if they are missing
+// then the rest of the text after the flags is the template.
+func parseStylePresetAdd(s string) (name string, preset stylePresetType, err error) {
+	// Some clients replace the quotes with typographic ones.
+	s = strings.NewReplacer("“", `"`, "”", `"`, "„", `"`).Replace(s)
+
+	var template string
+	if start := strings.Index(s, `"`); start >= 0 {
+		end := strings.LastIndex(s, `"`)
+		if end == start {
+			return "", stylePresetType{}, fmt.Errorf("missing closing quote")
+		}
+		template = s[start+1 : end]
+		s = s[:start]
+	}
+
+	words := strings.Fields(s)
+	if len(words) == 0 {
+		return "", stylePresetType{}, fmt.Errorf(`usage: add name (flags) "template"`)
+	}
+	name = strings.ToLower(words[0])
+	words = words[1:]
+
+	var flags []string
+	for i := 0; i < len(words); i++ {
+		if !strings.HasPrefix(words[i], "-") {
+			if template != "" {
+				return "", stylePresetType{}, fmt.Errorf("invalid flag: %s", words[i])
+			}
+			template = strings.Join(words[i:], " ")
+			break
+		}
+		flags = append(flags, words[i])
+		argName := strings.TrimPrefix(words[i], "-")
+		if slices.Contains(stylePresetValueFlags, argName) && i+1 < len(words) {
+			flags = append(flags, words[i+1])
+			i++
+		}
+	}
+
+	template = strings.TrimSpace(template)
+	switch {
+	case !stylePresetNameRegexp.MatchString(name):
+		err = fmt.Errorf("invalid name, use max. 32 lowercase letters, numbers, - or _")
+	case isModelStyle(name):
+		err = fmt.Errorf("name %s is reserved for the model style", name)
+	case template == "":
+		err = fmt.Errorf("missing template")
+	case len(template) > 1000:
+		err = fmt.Errorf("template is too long")
+	default:
+		err = validateStylePresetFlags(flags)
+	}
+	if err != nil {
+		return "", stylePresetType{}, err
+	}
+	return name, stylePresetType{Template: template, Flags: strings.Join(flags, " ")}, nil
+}
+
+func formatStylePresets(names []string, presets []stylePresetType) string {
+	var b strings.Builder
+	for i, name := range names {
+		b.WriteString("  " + name + ": " + presets[i].String() + "\n")
+	}
+	return b.String()
+}
+
+func (c *cmdHandlerType) Style(ctx context.Context) {
+	subCmd, rest, _ := strings.Cut(strings.TrimSpace(c.cmdMsg.Text), " ")
+	rest = strings.TrimSpace(rest)
+	isGroup := c.cmdMsg.Chat.ID < 0
+	owner := getCustomKeyOwner(c.cmdMsg.Chat.ID, c.cmdMsg.From.ID)
+	ownerStr := "your"
+	if isGroup {
+		ownerStr = "the group's"
+	}
+
+	if (subCmd == "add" || subCmd == "remove") && isGroup && !isChatAdmin(ctx, c.cmdMsg.Chat.ID, c.cmdMsg.From.ID) {
+		fmt.Println("  user is not a group admin")
+		_, _ = c.reply(ctx, errorStr+": only group admins can change the group's style presets")
+		return
+	}
+
+	switch subCmd {
+	case "", "list":
+		var s strings.Builder
+		s.WriteString("🎨 Style presets, use them with -style name\n\n")
+		if isGroup {
+			if names, presets := stylePresets.List(owner); len(names) > 0 {
+				s.WriteString("Group presets:\n" + formatStylePresets(names, presets) + "\n")
+			}
+		}
+		if names, presets := stylePresets.List(getCustomKeyOwner(0, c.cmdMsg.From.ID)); len(names) > 0 {
+			s.WriteString("Your presets:\n" + formatStylePresets(names, presets) + "\n")
+		}
+		var names []string
+		for name := range builtinStylePresets {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		var presets []stylePresetType
+		for _, name := range names {
+			presets = append(presets, builtinStylePresets[name])
+		}
+		s.WriteString("Built-in presets:\n" + formatStylePresets(names, presets))
+		_, _ = c.reply(ctx, s.String())
+	case "add":
+		name, preset, err := parseStylePresetAdd(rest)
+		if err == nil {
+			err = stylePresets.Set(owner, name, preset)
+		}
+		if err != nil {
+			fmt.Println("  can't add style preset:", err)
+			_, _ = c.reply(ctx, errorStr+": "+err.Error())
+			return
+		}
+		fmt.Println("  style preset", name, "stored")
+		_, _ = c.reply(ctx, "🎨 Style preset "+name+" stored in "+ownerStr+" presets")
+	case "remove":
+		name := strings.ToLower(rest)
+		if err := stylePresets.Remove(owner, name); err != nil {
+			fmt.Println("  can't remove style preset:", err)
+			_, _ = c.reply(ctx, errorStr+": "+err.Error())
+			return
+		}
+		fmt.Println("  style preset", name, "removed")
+		_, _ = c.reply(ctx, "🎨 Style preset "+name+" removed from "+ownerStr+" presets")
+	default:
+		_, _ = c.reply(ctx, errorStr+`: usage: list, add name (flags) "template", remove name`)
+	}
+}
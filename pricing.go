@@ -0,0 +1,87 @@
+package main
+
+import "fmt"
+
+// gpt-image-1 prices in USD per token, see https://platform.openai.com/docs/pricing
+const (
+	priceTextInputToken   = 5.0 / 1000000
+	priceImageInputToken  = 10.0 / 1000000
+	priceImageOutputToken = 40.0 / 1000000
+)
+
+// Cost returns the cost of the request calculated from the usage info in the response.
+func (r *ImagesResponseType) Cost() float64 {
+	u := r.Usage
+	textTokens := u.InputTokensDetails.TextTokens
+	imageTokens := u.InputTokensDetails.ImageTokens
+	if textTokens+imageTokens == 0 {
+		textTokens = u.InputTokens
+	}
+	return float64(textTokens)*priceTextInputToken + float64(imageTokens)*priceImageInputToken +
+		float64(u.OutputTokens)*priceImageOutputToken
+}
+
+// Output tokens of gpt-image-1 images by quality and size.
+var gptImageOutputTokens = map[string]map[string]int{
+	"low":    {"1024x1024": 272, "1024x1536": 408, "1536x1024": 400},
+	"medium": {"1024x1024": 1056, "1024x1536": 1584, "1536x1024": 1568},
+	"high":   {"1024x1024": 4160, "1024x1536": 6240, "1536x1024": 6208},
+}
+
+// Prices of DALL-E images in USD by quality and size.
+var dallEImagePrices = map[string]map[string]map[string]float64{
+	"dall-e-3": {
+		"standard": {"1024x1024": 0.04, "1024x1792": 0.08, "1792x1024": 0.08},
+		"hd":       {"1024x1024": 0.08, "1024x1792": 0.12, "1792x1024": 0.12},
+	},
+	"dall-e-2": {
+		"": {"256x256": 0.016, "512x512": 0.018, "1024x1024": 0.02},
+	},
+}
+
+// Input tokens of an input image of edit requests, calculated for a 1024x1024 image.
+const gptImageInputImageTokens = 765
+
+// estimateImagesCost returns the estimated cost of generating images with the given args and number of
+// input images. As the output size is not known for auto size and quality, the most expensive option is
+// assumed. Returns false if there's no pricing info for the model.
+func estimateImagesCost(args imagenArgsType, inputImages int) (float64, bool) {
+	m, err := getImageModel(args.Model)
+	if err != nil {
+		return 0, false
+	}
+	quality := m.supported(m.Qualities, args.Quality)
+	size := m.supported(m.Sizes, args.Size)
+
+	if prices, ok := dallEImagePrices[m.Name]; ok {
+		if quality == "" && len(m.Qualities) > 0 {
+			quality = m.Qualities[0]
+		}
+		if size == "" {
+			size = "1024x1024"
+		}
+		price, ok := prices[quality][size]
+		return price * float64(args.N), ok
+	}
+
+	if m.Name != "gpt-image-1" {
+		return 0, false
+	}
+	if quality == "" || quality == "auto" {
+		quality = "high"
+	}
+	if size == "" || size == "auto" {
+		size = "1024x1536"
+	}
+	outputTokens, ok := gptImageOutputTokens[quality][size]
+	if !ok {
+		return 0, false
+	}
+	// Roughly 4 characters per text token.
+	return float64(len(args.Prompt)/4)*priceTextInputToken + float64(inputImages*gptImageInputImageTokens)*priceImageInputToken +
+		float64(outputTokens*args.N)*priceImageOutputToken, true
+}
+
+func formatCost(cost float64) string {
+	return fmt.Sprintf("$%.2f", cost)
+}
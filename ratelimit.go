@@ -0,0 +1,131 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"sync"
+	"time"
+
+	"golang.org/x/exp/slices"
+)
+
+type tokenBucketType struct {
+	tokens     float64
+	lastRefill time.Time
+}
+
+// refill adds the tokens accumulated since the last refill. The bucket refills capacity tokens during
+// the given period.
+func (b *tokenBucketType) refill(capacity float64, period time.Duration) {
+	now := time.Now()
+	if b.lastRefill.IsZero() {
+		b.tokens = capacity
+	} else {
+		b.tokens = math.Min(capacity, b.tokens+capacity*float64(now.Sub(b.lastRefill))/float64(period))
+	}
+	b.lastRefill = now
+}
+
+// waitTime returns how long to wait until n tokens are available.
+func (b *tokenBucketType) waitTime(n, capacity float64, period time.Duration) time.Duration {
+	if b.tokens >= n {
+		return 0
+	}
+	return time.Duration((n - b.tokens) / capacity * float64(period))
+}
+
+type rateLimitType struct {
+	name     string
+	capacity int
+	period   time.Duration
+	isImages bool // Counts images instead of requests.
+}
+
+type rateLimiterType struct {
+	mutex   sync.Mutex
+	buckets map[string]*tokenBucketType
+}
+
+var rateLimiter rateLimiterType
+
+func (r *rateLimiterType) getLimits(userID, chatID int64) (keys []string, limits []rateLimitType) {
+	add := func(key string, limit rateLimitType) {
+		if limit.capacity > 0 {
+			keys = append(keys, key)
+			limits = append(limits, limit)
+		}
+	}
+
+	u := strconv.FormatInt(userID, 10)
+	add("user-requests:"+u, rateLimitType{"requests per minute", params.UserRequestsPerMinute, time.Minute, false})
+	add("user-images:"+u, rateLimitType{"images per hour", params.UserImagesPerHour, time.Hour, true})
+	if chatID < 0 { // Group?
+		g := strconv.FormatInt(chatID, 10)
+		add("group-requests:"+g, rateLimitType{"group requests per minute", params.GroupRequestsPerMinute, time.Minute, false})
+		add("group-images:"+g, rateLimitType{"group images per hour", params.GroupImagesPerHour, time.Hour, true})
+	}
+	return
+}
+
+// Allow checks if the user can make a request for the given number of images in the given chat, and takes
+// the tokens from all buckets if so. Otherwise it returns an error telling the user when to try again.
+// Admins are exempt from rate limiting.
+func (r *rateLimiterType) Allow(userID, chatID int64, images int) error {
+	return r.check(userID, chatID, images, true)
+}
+
+// Check is like Allow, but it doesn't take the tokens, so requests which are only counted later can be
+// rejected early.
+func (r *rateLimiterType) Check(userID, chatID int64, images int) error {
+	return r.check(userID, chatID, images, false)
+}
+
+func (r *rateLimiterType) check(userID, chatID int64, images int, take bool) error {
+	if slices.Contains(params.AdminUserIDs, userID) {
+		return nil
+	}
+
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	if r.buckets == nil {
+		r.buckets = make(map[string]*tokenBucketType)
+	}
+
+	keys, limits := r.getLimits(userID, chatID)
+	var wait time.Duration
+	for i, key := range keys {
+		n := 1.0
+		if limits[i].isImages {
+			n = float64(images)
+			if images > limits[i].capacity {
+				return fmt.Errorf("too many images requested, the limit is %d %s", limits[i].capacity, limits[i].name)
+			}
+		}
+
+		b, ok := r.buckets[key]
+		if !ok {
+			b = &tokenBucketType{}
+			r.buckets[key] = b
+		}
+		b.refill(float64(limits[i].capacity), limits[i].period)
+		wait = max(wait, b.waitTime(n, float64(limits[i].capacity), limits[i].period))
+	}
+
+	if wait > 0 {
+		return fmt.Errorf("rate limit reached, try again in %s", wait.Round(time.Second))
+	}
+	if !take {
+		return nil
+	}
+
+	for i, key := range keys {
+		if limits[i].isImages {
+			r.buckets[key].tokens -= float64(images)
+		} else {
+			r.buckets[key].tokens--
+		}
+	}
+	return nil
+}
@@ -8,8 +8,49 @@ if [ ! -x "$bin" ]; then
 fi
 
 OPENAI_API_KEY=$OPENAI_API_KEY \
+OPENAI_API_KEYS=$OPENAI_API_KEYS \
+OPENAI_KEY_SELECTION=$OPENAI_KEY_SELECTION \
+OPENAI_BASE_URL=$OPENAI_BASE_URL \
+OPENAI_HEADERS="$OPENAI_HEADERS" \
+OPENAI_PROXY=$OPENAI_PROXY \
+AZURE_API_VERSION=$AZURE_API_VERSION \
+IMAGE_MODEL=$IMAGE_MODEL \
+IMAGE_MODELS_FILE=$IMAGE_MODELS_FILE \
+UPSCALER_CMD="$UPSCALER_CMD" \
+GRID_WITH_ALBUM=$GRID_WITH_ALBUM \
+SEND_ORIGINALS_CHATIDS=$SEND_ORIGINALS_CHATIDS \
+PROMPT_MATRIX_MAX=$PROMPT_MATRIX_MAX \
+WATERMARK=$WATERMARK \
+CHAT_WATERMARK=$CHAT_WATERMARK \
+WATERMARK_TEXT="$WATERMARK_TEXT" \
+WATERMARK_LOGO="$WATERMARK_LOGO" \
+WATERMARK_POSITION=$WATERMARK_POSITION \
+WATERMARK_OPACITY=$WATERMARK_OPACITY \
+KEY_ENCRYPTION_KEY=$KEY_ENCRYPTION_KEY \
+CUSTOM_KEY_FALLBACK=$CUSTOM_KEY_FALLBACK \
 BOT_TOKEN=$BOT_TOKEN \
 ALLOWED_USERIDS=$ALLOWED_USERIDS \
 ADMIN_USERIDS=$ADMIN_USERIDS \
 ALLOWED_GROUPIDS=$ALLOWED_GROUPIDS \
+BOT_DESCRIPTION="$BOT_DESCRIPTION" \
+BOT_SHORT_DESCRIPTION="$BOT_SHORT_DESCRIPTION" \
+VISION_MODEL=$VISION_MODEL \
+MODERATION=$MODERATION \
+GROUP_MODERATION=$GROUP_MODERATION \
+MODERATION_PREFLIGHT=$MODERATION_PREFLIGHT \
+PROMPT_DENYLIST_FILE=$PROMPT_DENYLIST_FILE \
+INLINE_STORAGE_CHATID=$INLINE_STORAGE_CHATID \
+USER_REQUESTS_PER_MINUTE=$USER_REQUESTS_PER_MINUTE \
+USER_IMAGES_PER_HOUR=$USER_IMAGES_PER_HOUR \
+GROUP_REQUESTS_PER_MINUTE=$GROUP_REQUESTS_PER_MINUTE \
+GROUP_IMAGES_PER_HOUR=$GROUP_IMAGES_PER_HOUR \
+CONFIRM_COST_THRESHOLD=$CONFIRM_COST_THRESHOLD \
+SHUTDOWN_GRACE_PERIOD=$SHUTDOWN_GRACE_PERIOD \
+DATA_DIR=$DATA_DIR \
+INTERRUPTED_JOB_MODE=$INTERRUPTED_JOB_MODE \
+INTERRUPTED_JOB_MAX_AGE=$INTERRUPTED_JOB_MAX_AGE \
+INLINE_MAX_IMAGES_PER_HOUR=$INLINE_MAX_IMAGES_PER_HOUR \
+ARCHIVE_CHATID=$ARCHIVE_CHATID \
+ARCHIVE_EXCLUDE_GROUPIDS=$ARCHIVE_EXCLUDE_GROUPIDS \
+ARCHIVE_SKIP_PRIVATE=$ARCHIVE_SKIP_PRIVATE \
 $bin $*
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// jobTrackerType keeps count of the in-flight jobs, so they can be drained on shutdown.
+type jobTrackerType struct {
+	mutex      sync.Mutex
+	count      int
+	stopping   bool
+	stoppingCh chan struct{} // Closed when the shutdown starts.
+	idleCh     chan struct{} // Closed when stopping and all jobs have finished.
+}
+
+var jobTracker = jobTrackerType{
+	stoppingCh: make(chan struct{}),
+	idleCh:     make(chan struct{}),
+}
+
+// Start registers a new job. Returns false if the bot is stopping, so the job shouldn't be started.
+func (j *jobTrackerType) Start() bool {
+	j.mutex.Lock()
+	defer j.mutex.Unlock()
+
+	if j.stopping {
+		return false
+	}
+	j.count++
+	return true
+}
+
+func (j *jobTrackerType) Done() {
+	j.mutex.Lock()
+	defer j.mutex.Unlock()
+
+	j.count--
+	if j.stopping && j.count == 0 {
+		close(j.idleCh)
+	}
+}
+
+// Stopping returns a channel which gets closed when the shutdown starts.
+func (j *jobTrackerType) Stopping() <-chan struct{} {
+	return j.stoppingCh
+}
+
+// Stop prevents new jobs from starting and waits for the in-flight jobs to finish. Returns false if the
+// jobs haven't finished within the given timeout.
+func (j *jobTrackerType) Stop(timeout time.Duration) bool {
+	j.mutex.Lock()
+	if !j.stopping {
+		j.stopping = true
+		close(j.stoppingCh)
+		if j.count == 0 {
+			close(j.idleCh)
+		}
+	}
+	count := j.count
+	j.mutex.Unlock()
+
+	if count > 0 {
+		fmt.Println("waiting for", count, "in-flight jobs to finish...")
+	}
+
+	select {
+	case <-j.idleCh:
+		return true
+	case <-time.After(timeout):
+		return false
+	}
+}
+
+// shutdown drains the in-flight jobs and cancels the ones still running after the grace period.
+func shutdown(ctx context.Context, cancel context.CancelFunc, botStopped <-chan struct{}) {
+	fmt.Println("imagen-telegram-bot stopping...")
+	sendTextToAdmins(ctx, "🤖 Bot stopping")
+
+	if !jobTracker.Stop(params.ShutdownGracePeriod) {
+		fmt.Println("grace period expired, canceling in-flight jobs")
+	}
+	cancel()
+
+	select {
+	case <-botStopped:
+	case <-time.After(5 * time.Second):
+	}
+	fmt.Println("imagen-telegram-bot stopped")
+}
@@ -0,0 +1,187 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"image"
+	"image/draw"
+	"math"
+	"strconv"
+	"strings"
+
+	"golang.org/x/exp/slices"
+)
+
+// Size shorthands and the resolution they stand for.
+var sizeShorthands = map[string][2]int{
+	"720p":  {1280, 720},
+	"hd":    {1280, 720},
+	"1080p": {1920, 1080},
+	"fhd":   {1920, 1080},
+	"1440p": {2560, 1440},
+	"2k":    {2560, 1440},
+	"2160p": {3840, 2160},
+	"4k":    {3840, 2160},
+}
+
+// Max. ratio of the long and the short side for the aspect ratio flags.
+const maxAspectRatio = 4
+const maxAspectRatioValue = 100000
+
+// Aspect ratios of the orientation flags.
+var orientationShorthands = map[string][2]int{
+	"square":    {1, 1},
+	"portrait":  {2, 3},
+	"landscape": {3, 2},
+}
+
+// parseDimensions parses the "WxH" (or "W:H" if sep is ":") format.
+func parseDimensions(s, sep string) (w, h int, err error) {
+	ws, hs, found := strings.Cut(strings.ToLower(s), sep)
+	if !found {
+		return 0, 0, fmt.Errorf("invalid format: %s", s)
+	}
+	w, err = strconv.Atoi(ws)
+	if err == nil {
+		h, err = strconv.Atoi(hs)
+	}
+	if err != nil || w <= 0 || h <= 0 {
+		return 0, 0, fmt.Errorf("invalid format: %s", s)
+	}
+	return
+}
+
+// parseAspectRatio parses the "W:H" format, and checks that the aspect ratio is between 1:maxAspectRatio
+// and maxAspectRatio:1, so extreme ratios can't result in empty or huge images.
+func parseAspectRatio(s string) (w, h int, err error) {
+	w, h, err = parseDimensions(s, ":")
+	if err != nil || w > maxAspectRatioValue || h > maxAspectRatioValue {
+		return 0, 0, fmt.Errorf("invalid aspect ratio: %s", s)
+	}
+	if r := float64(w) / float64(h); r > maxAspectRatio || r < 1/float64(maxAspectRatio) {
+		return 0, 0, fmt.Errorf("aspect ratio %s is out of range, it should be between 1:%d and %d:1", s,
+			maxAspectRatio, maxAspectRatio)
+	}
+	return
+}
+
+// getNearestSize returns the size supported by the model with the aspect ratio closest to the given one. On
+// equal aspect ratios the larger size wins.
+func (m *imageModelType) getNearestSize(w, h int) (string, error) {
+	target := math.Log(float64(w) / float64(h))
+	var best string
+	var bestDiff float64
+	var bestArea int
+	for _, s := range m.Sizes {
+		sw, sh, err := parseDimensions(s, "x")
+		if err != nil { // Sizes like "auto".
+			continue
+		}
+		diff := math.Abs(math.Log(float64(sw)/float64(sh)) - target)
+		if best == "" || diff < bestDiff-0.001 || (diff < bestDiff+0.001 && sw*sh > bestArea) {
+			best, bestDiff, bestArea = s, diff, sw*sh
+		}
+	}
+	if best == "" {
+		return "", fmt.Errorf("model %s doesn't support setting the size", m.Name)
+	}
+	return best, nil
+}
+
+// cropToAspect crops the center of the image to the given aspect ratio.
+func cropToAspect(src image.Image, w, h int) image.Image {
+	b := src.Bounds()
+	cw, ch := b.Dx(), b.Dy()
+	if cw*h > ch*w {
+		cw = ch * w / h
+	} else {
+		ch = cw * h / w
+	}
+	if cw == b.Dx() && ch == b.Dy() {
+		return src
+	}
+	dst := image.NewNRGBA(image.Rect(0, 0, cw, ch))
+	draw.Draw(dst, dst.Bounds(), src, b.Min.Add(image.Pt((b.Dx()-cw)/2, (b.Dy()-ch)/2)), draw.Src)
+	return dst
+}
+
+// fitToExact crops the image to the given aspect ratio ("W:H"), or crops and resizes it to the given
+// size ("WxH").
+func fitToExact(data []byte, exact string) ([]byte, error) {
+	img, _, err := image.Decode(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+
+	if w, h, err := parseDimensions(exact, ":"); err == nil {
+		img = cropToAspect(img, w, h)
+	} else if w, h, err := parseDimensions(exact, "x"); err == nil {
+		img = resizeImage(cropToAspect(img, w, h), w, h)
+	} else {
+		return nil, err
+	}
+	return encodeImage(img, false)
+}
+
+// getImageSize returns the size of the given image data in "WxH" format, or an empty string if it can't be
+// decoded.
+func getImageSize(data []byte) string {
+	cfg, _, err := image.DecodeConfig(bytes.NewReader(data))
+	if err != nil {
+		return ""
+	}
+	return fmt.Sprint(cfg.Width, "x", cfg.Height)
+}
+
+// resolveSizeShorthands maps the aspect ratio and size shorthands to the nearest size supported by the
+// model. If exact is set, the output will be cropped/resized locally to the requested aspect ratio or size.
+func (m *imageModelType) resolveSizeShorthands(args *imagenArgsType, aspectRatio string, exact bool) error {
+	var w, h int
+	shorthand, isShorthand := sizeShorthands[strings.ToLower(args.Size)]
+	if isShorthand {
+		w, h = shorthand[0], shorthand[1]
+	}
+
+	if aspectRatio != "" {
+		aw, ah, err := parseAspectRatio(aspectRatio)
+		if err != nil {
+			return err
+		}
+		if isShorthand {
+			// Keeping the long side of the size shorthand.
+			long := max(w, h)
+			if aw >= ah {
+				w, h = long, long*ah/aw
+			} else {
+				w, h = long*aw/ah, long
+			}
+		} else {
+			w, h = aw, ah
+		}
+	}
+
+	if w == 0 {
+		if exact {
+			return fmt.Errorf("exact needs an aspect ratio or a size shorthand")
+		}
+		return nil
+	}
+
+	size, err := m.getNearestSize(w, h)
+	if err != nil {
+		return err
+	}
+	args.Size = size
+	if !slices.Contains(args.ArgsPresent, "size") {
+		args.ArgsPresent = append(args.ArgsPresent, "size")
+	}
+
+	if exact {
+		if isShorthand {
+			args.Exact = fmt.Sprint(w, "x", h)
+		} else {
+			args.Exact = fmt.Sprint(w, ":", h)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,256 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"image"
+	"image/draw"
+	"math"
+	"os"
+	"os/exec"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync"
+
+	xdraw "golang.org/x/image/draw"
+)
+
+const maxUpscaleFactor = 4
+const maxUpscaledImageDimension = 8192
+const maxUpscaledImageBytes = 50 * 1024 * 1024 // Telegram upload limit.
+const upscaleSharpenAmount = 0.6
+const upscaleSharpenTileHeight = 128
+
+// upscalerType is implemented by the upscaler backends.
+type upscalerType interface {
+	Upscale(ctx context.Context, data []byte, factor int, sharpen bool) ([]byte, error)
+}
+
+// getUpscaler returns the external upscaler if it's configured, otherwise the built-in one.
+func getUpscaler() upscalerType {
+	if params.UpscalerCmd != "" {
+		return commandUpscalerType{cmd: params.UpscalerCmd}
+	}
+	return localUpscalerType{}
+}
+
+// Lanczos kernel with a support of 3.
+var lanczos3 = &xdraw.Kernel{
+	Support: 3,
+	At: func(t float64) float64 {
+		if t == 0 {
+			return 1
+		}
+		return 3 * math.Sin(math.Pi*t) * math.Sin(math.Pi*t/3) / (math.Pi * math.Pi * t * t)
+	},
+}
+
+// localUpscalerType upscales using Lanczos resampling, optionally followed by an unsharp mask.
+type localUpscalerType struct{}
+
+func (u localUpscalerType) Upscale(ctx context.Context, data []byte, factor int, sharpen bool) ([]byte, error) {
+	img, _, err := image.Decode(bytes.NewReader(data))
+	if err != nil {
+		return nil, fmt.Errorf(unsupportedImageFormatStr)
+	}
+
+	b := img.Bounds()
+	dst := image.NewNRGBA(image.Rect(0, 0, b.Dx()*factor, b.Dy()*factor))
+	lanczos3.Scale(dst, dst.Bounds(), img, b, draw.Src, nil)
+	if ctx.Err() != nil {
+		return nil, ctx.Err()
+	}
+	if sharpen {
+		dst = sharpenImage(dst, upscaleSharpenAmount)
+	}
+	return encodeImage(dst, false)
+}
+
+// sharpenImage applies an unsharp mask with a 3x3 box blur. The image is processed in tiles in parallel.
+func sharpenImage(src *image.NRGBA, amount float64) *image.NRGBA {
+	b := src.Bounds()
+	dst := image.NewNRGBA(b)
+
+	tiles := make(chan int)
+	var wg sync.WaitGroup
+	for i := 0; i < runtime.NumCPU(); i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for y0 := range tiles {
+				sharpenTile(src, dst, y0, min(y0+upscaleSharpenTileHeight, b.Max.Y), amount)
+			}
+		}()
+	}
+	for y := b.Min.Y; y < b.Max.Y; y += upscaleSharpenTileHeight {
+		tiles <- y
+	}
+	close(tiles)
+	wg.Wait()
+	return dst
+}
+
+func sharpenTile(src, dst *image.NRGBA, y0, y1 int, amount float64) {
+	b := src.Bounds()
+	for y := y0; y < y1; y++ {
+		for x := b.Min.X; x < b.Max.X; x++ {
+			o := src.PixOffset(x, y)
+			var sum [3]int
+			count := 0
+			for dy := -1; dy <= 1; dy++ {
+				for dx := -1; dx <= 1; dx++ {
+					p := image.Pt(x+dx, y+dy)
+					if !p.In(b) {
+						continue
+					}
+					no := src.PixOffset(p.X, p.Y)
+					sum[0] += int(src.Pix[no])
+					sum[1] += int(src.Pix[no+1])
+					sum[2] += int(src.Pix[no+2])
+					count++
+				}
+			}
+			for c := 0; c < 3; c++ {
+				v := float64(src.Pix[o+c])
+				v += amount * (v - float64(sum[c])/float64(count))
+				dst.Pix[o+c] = uint8(max(0, min(255, math.Round(v))))
+			}
+			dst.Pix[o+3] = src.Pix[o+3]
+		}
+	}
+}
+
+// commandUpscalerType runs an external command which gets the image on stdin and the scale factor in the
+// UPSCALE_FACTOR (and UPSCALE_SHARPEN) env vars, and should output the upscaled image to stdout.
+type commandUpscalerType struct {
+	cmd string
+}
+
+func (u commandUpscalerType) Upscale(ctx context.Context, data []byte, factor int, sharpen bool) ([]byte, error) {
+	cmd := exec.CommandContext(ctx, "sh", "-c", u.cmd)
+	cmd.Env = append(os.Environ(), "UPSCALE_FACTOR="+strconv.Itoa(factor), "UPSCALE_SHARPEN="+strconv.FormatBool(sharpen))
+	cmd.Stdin = bytes.NewReader(data)
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	out, err := cmd.Output()
+	if err != nil {
+		fmt.Println("    upscaler command error:", strings.TrimSpace(stderr.String()))
+		return nil, fmt.Errorf("upscaler command failed: %w", err)
+	}
+	if _, _, err := image.DecodeConfig(bytes.NewReader(out)); err != nil {
+		return nil, fmt.Errorf("upscaler command returned invalid image data")
+	}
+	return out, nil
+}
+
+// limitUpscaledImageSize makes sure the image can be uploaded to Telegram. Too big opaque images are
+// re-encoded as JPEG, and if it's still too big (or it has transparency), the image is downscaled until it
+// fits.
+func limitUpscaledImageSize(d []byte) ([]byte, error) {
+	if len(d) <= maxUpscaledImageBytes {
+		return d, nil
+	}
+	img, _, err := decodeImage(d)
+	if err != nil {
+		return nil, err
+	}
+	o, ok := img.(interface{ Opaque() bool })
+	asJPEG := ok && o.Opaque()
+
+	fmt.Println("    upscaled image is too big,", len(d), "bytes, re-encoding...")
+	for {
+		if d, err = encodeImage(img, asJPEG); err != nil {
+			return nil, fmt.Errorf("can't encode image: %w", err)
+		}
+		if len(d) <= maxUpscaledImageBytes {
+			return d, nil
+		}
+		b := img.Bounds()
+		img = fitImage(img, max(b.Dx(), b.Dy())*3/4)
+	}
+}
+
+// parseUpscaleFactor parses the "2x" format.
+func parseUpscaleFactor(s string) (int, error) {
+	f, err := strconv.Atoi(strings.TrimSuffix(strings.ToLower(s), "x"))
+	if err != nil || f < 2 || f > maxUpscaleFactor {
+		return 0, fmt.Errorf("invalid upscale factor %s, should be between 2x and %dx", s, maxUpscaleFactor)
+	}
+	return f, nil
+}
+
+// upscaleImages upscales the given images with the configured upscaler.
+func upscaleImages(ctx context.Context, imgs [][]byte, factor int, sharpen bool) (res [][]byte, err error) {
+	for _, d := range imgs {
+		cfg, _, err := image.DecodeConfig(bytes.NewReader(d))
+		if err != nil {
+			return nil, fmt.Errorf(unsupportedImageFormatStr)
+		}
+		if max(cfg.Width, cfg.Height)*factor > maxUpscaledImageDimension {
+			return nil, fmt.Errorf("upscaled image would be too big, max. size is %dpx", maxUpscaledImageDimension)
+		}
+
+		fmt.Println("    upscaling", cfg.Width, "x", cfg.Height, "image", factor, "times...")
+		d, err = getUpscaler().Upscale(ctx, d, factor, sharpen)
+		if err == nil {
+			d, err = limitUpscaledImageSize(d)
+		}
+		if err != nil {
+			return nil, err
+		}
+		res = append(res, d)
+	}
+	return
+}
+
+func (c *cmdHandlerType) Upscale(ctx context.Context) {
+	factor := 2
+	sharpen := false
+	for _, word := range strings.Fields(c.cmdMsg.Text) {
+		if word == "-sharpen" {
+			sharpen = true
+			continue
+		}
+		var err error
+		if factor, err = parseUpscaleFactor(word); err != nil {
+			fmt.Println("  ", err)
+			_, _ = c.reply(ctx, errorStr+": "+err.Error())
+			return
+		}
+	}
+
+	imgs, err := c.waitForImages(ctx)
+	if err == nil && len(imgs) == 0 {
+		fmt.Println("    canceled")
+		return
+	}
+	if err != nil {
+		fmt.Println("    error:", err)
+		_, _ = c.reply(ctx, errorStr+": "+err.Error())
+		return
+	}
+
+	var data [][]byte
+	for _, img := range imgs {
+		data = append(data, img.Data)
+	}
+
+	typingHandler.ChangeTypingStatus(c.cmdMsg.Chat.ID, c.cmdMsg.ID, true)
+	data, err = upscaleImages(ctx, data, factor, sharpen)
+	typingHandler.ChangeTypingStatus(c.cmdMsg.Chat.ID, c.cmdMsg.ID, false)
+	if err != nil {
+		fmt.Println("    upscale error:", err)
+		_, _ = c.reply(ctx, errorStr+": "+err.Error())
+		return
+	}
+
+	fmt.Println("    uploading upscaled images...")
+	_, err = uploadDocuments(ctx, c.cmdMsg, fmt.Sprintf("🔍 Upscaled %dx", factor), data)
+	if err != nil {
+		_, _ = c.reply(ctx, errorStr+": "+err.Error())
+		return
+	}
+	fmt.Println("    images uploaded successfully")
+}
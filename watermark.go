@@ -0,0 +1,364 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"hash/crc32"
+	"image"
+	"image/color"
+	"image/draw"
+	"math"
+	"math/bits"
+	"os"
+	"strconv"
+	"strings"
+
+	xdraw "golang.org/x/image/draw"
+	"golang.org/x/image/font"
+	"golang.org/x/image/font/basicfont"
+	"golang.org/x/image/math/fixed"
+)
+
+const (
+	watermarkOff       = "off"
+	watermarkVisible   = "visible"
+	watermarkInvisible = "invisible"
+	watermarkBoth      = "both"
+)
+
+var watermarkModes = []string{watermarkOff, watermarkVisible, watermarkInvisible, watermarkBoth}
+var watermarkPositions = []string{"top-left", "top-right", "bottom-left", "bottom-right", "center"}
+
+// The invisible watermark is embedded into the mean luminance of the cells of a fixed size grid, so it
+// survives JPEG recompression and resizing. Each bit of the payload is repeated in multiple cells.
+const invisibleWatermarkGridSize = 32
+const invisibleWatermarkStep = 4.0           // Quantization step of the cell means.
+const invisibleWatermarkPayloadBits = 32 + 8 // Generation ID and checksum.
+const invisibleWatermarkMinAgreement = 50    // Min. percentage of the cells which have to agree on the payload.
+
+// parseChatWatermark parses the "chatID:mode,chatID:mode" format.
+func parseChatWatermark(s string) (map[int64]string, error) {
+	res := make(map[int64]string)
+	for _, item := range strings.Split(s, ",") {
+		if item == "" {
+			continue
+		}
+		idStr, mode, found := strings.Cut(item, ":")
+		if !found {
+			return nil, fmt.Errorf("chat watermark setting has no mode: %s", item)
+		}
+		id, err := strconv.ParseInt(idStr, 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("chat watermark setting contains invalid chat ID: %s", idStr)
+		}
+		if !isValidWatermarkMode(mode) {
+			return nil, fmt.Errorf("chat watermark setting contains invalid mode: %s", mode)
+		}
+		res[id] = mode
+	}
+	return res, nil
+}
+
+func isValidWatermarkMode(mode string) bool {
+	for _, m := range watermarkModes {
+		if m == mode {
+			return true
+		}
+	}
+	return false
+}
+
+// getWatermarkMode returns the watermark mode to be used for the given chat.
+func getWatermarkMode(chatID int64) string {
+	if mode, ok := params.ChatWatermark[chatID]; ok {
+		return mode
+	}
+	return params.Watermark
+}
+
+// newGenerationID returns a random ID which identifies the generated images.
+func newGenerationID() string {
+	b := make([]byte, 4)
+	_, _ = rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+type watermarkHandlerType struct {
+	logo image.Image
+}
+
+var watermarkHandler watermarkHandlerType
+
+func (w *watermarkHandlerType) LoadLogo(filename string) error {
+	d, err := os.ReadFile(filename)
+	if err != nil {
+		return fmt.Errorf("can't read watermark logo: %w", err)
+	}
+	w.logo, _, err = image.Decode(bytes.NewReader(d))
+	if err != nil {
+		return fmt.Errorf("can't decode watermark logo: %w", err)
+	}
+	return nil
+}
+
+// getWatermarkRect returns the rectangle of the given size placed to the configured position.
+func getWatermarkRect(b image.Rectangle, size image.Point) image.Rectangle {
+	margin := max(b.Dx(), b.Dy()) / 50
+	var p image.Point
+	switch params.WatermarkPosition {
+	case "top-left":
+		p = image.Pt(b.Min.X+margin, b.Min.Y+margin)
+	case "top-right":
+		p = image.Pt(b.Max.X-margin-size.X, b.Min.Y+margin)
+	case "bottom-left":
+		p = image.Pt(b.Min.X+margin, b.Max.Y-margin-size.Y)
+	case "center":
+		p = image.Pt(b.Min.X+(b.Dx()-size.X)/2, b.Min.Y+(b.Dy()-size.Y)/2)
+	default:
+		p = image.Pt(b.Max.X-margin-size.X, b.Max.Y-margin-size.Y)
+	}
+	return image.Rectangle{Min: p, Max: p.Add(size)}
+}
+
+// renderWatermark returns the logo (if set) and the text as one image.
+func (w *watermarkHandlerType) renderWatermark(imgWidth int) image.Image {
+	var parts []image.Image
+	if w.logo != nil {
+		lb := w.logo.Bounds()
+		lw := max(1, imgWidth/8)
+		lh := max(1, lb.Dy()*lw/lb.Dx())
+		logo := image.NewNRGBA(image.Rect(0, 0, lw, lh))
+		xdraw.CatmullRom.Scale(logo, logo.Bounds(), w.logo, lb, draw.Src, nil)
+		parts = append(parts, logo)
+	}
+	if params.WatermarkText != "" {
+		face := basicfont.Face7x13
+		text := image.NewNRGBA(image.Rect(0, 0, font.MeasureString(face, params.WatermarkText).Ceil()+4, face.Height+2))
+		draw.Draw(text, text.Bounds(), image.NewUniform(color.NRGBA{0, 0, 0, 160}), image.Point{}, draw.Src)
+		d := font.Drawer{Dst: text, Src: image.White, Face: face, Dot: fixed.P(2, face.Ascent+1)}
+		d.DrawString(params.WatermarkText)
+
+		// Scaling the small bitmap font to about 1/4 of the image width.
+		scale := max(1, imgWidth/4/text.Bounds().Dx())
+		scaled := image.NewNRGBA(image.Rect(0, 0, text.Bounds().Dx()*scale, text.Bounds().Dy()*scale))
+		xdraw.NearestNeighbor.Scale(scaled, scaled.Bounds(), text, text.Bounds(), draw.Src, nil)
+		parts = append(parts, scaled)
+	}
+
+	// Placing the parts under each other.
+	width, height := 0, 0
+	for _, p := range parts {
+		width = max(width, p.Bounds().Dx())
+		height += p.Bounds().Dy()
+	}
+	res := image.NewNRGBA(image.Rect(0, 0, width, height))
+	y := 0
+	for _, p := range parts {
+		pb := p.Bounds()
+		draw.Draw(res, image.Rect((width-pb.Dx())/2, y, (width-pb.Dx())/2+pb.Dx(), y+pb.Dy()), p, pb.Min, draw.Over)
+		y += pb.Dy()
+	}
+	return res
+}
+
+func (w *watermarkHandlerType) addVisibleWatermark(img *image.NRGBA) {
+	if w.logo == nil && params.WatermarkText == "" {
+		return
+	}
+	b := img.Bounds()
+	wm := w.renderWatermark(b.Dx())
+	r := getWatermarkRect(b, wm.Bounds().Size())
+	alpha := uint8(params.WatermarkOpacity * 255 / 100)
+	draw.DrawMask(img, r, wm, image.Point{}, image.NewUniform(color.Alpha{alpha}), image.Point{}, draw.Over)
+}
+
+func getWatermarkPayload(id string) (payload []bool, err error) {
+	d, err := hex.DecodeString(id)
+	if err != nil || len(d) != 4 {
+		return nil, fmt.Errorf("invalid generation ID: %s", id)
+	}
+	d = append(d, byte(crc32.ChecksumIEEE(d)))
+	for _, b := range d {
+		for i := 7; i >= 0; i-- {
+			payload = append(payload, b&(1<<i) != 0)
+		}
+	}
+	return
+}
+
+// getWatermarkCell returns the rectangle of the given grid cell.
+func getWatermarkCell(b image.Rectangle, i int) image.Rectangle {
+	cx, cy := i%invisibleWatermarkGridSize, i/invisibleWatermarkGridSize
+	return image.Rect(
+		b.Min.X+cx*b.Dx()/invisibleWatermarkGridSize, b.Min.Y+cy*b.Dy()/invisibleWatermarkGridSize,
+		b.Min.X+(cx+1)*b.Dx()/invisibleWatermarkGridSize, b.Min.Y+(cy+1)*b.Dy()/invisibleWatermarkGridSize,
+	)
+}
+
+// isWatermarkCellFlipped returns true if the bit carried by the given cell is flipped. The bits are flipped
+// by a fixed pseudo random pattern, so uniform images without a watermark don't decode to a valid payload.
+func isWatermarkCellFlipped(i int) bool {
+	return bits.OnesCount32(uint32(i)*0x9e3779b1)%2 == 1
+}
+
+// getCellMeanLuminance returns the mean luminance of the non-transparent pixels of the given cell, measured
+// on the same non-premultiplied values which are shifted by the watermarking. It returns false if most of
+// the cell is transparent.
+func getCellMeanLuminance(img *image.NRGBA, r image.Rectangle) (float64, bool) {
+	var sum float64
+	var n int
+	for y := r.Min.Y; y < r.Max.Y; y++ {
+		for x := r.Min.X; x < r.Max.X; x++ {
+			p := img.Pix[img.PixOffset(x, y):]
+			if p[3] == 0 {
+				continue
+			}
+			sum += 0.299*float64(p[0]) + 0.587*float64(p[1]) + 0.114*float64(p[2])
+			n++
+		}
+	}
+	if n == 0 || n < r.Dx()*r.Dy()/2 {
+		return 0, false
+	}
+	return sum / float64(n), true
+}
+
+// getWatermarkTarget returns the nearest point of the bit's quantization lattice to the given mean, which
+// stays inside [step, 255-step], so the shift is not lost to clipping in very dark or bright cells.
+func getWatermarkTarget(mean float64, bit bool) float64 {
+	offset := 0.0
+	if bit {
+		offset = invisibleWatermarkStep / 2
+	}
+	target := math.Round((mean-offset)/invisibleWatermarkStep)*invisibleWatermarkStep + offset
+	for target < invisibleWatermarkStep {
+		target += invisibleWatermarkStep
+	}
+	for target > 255-invisibleWatermarkStep {
+		target -= invisibleWatermarkStep
+	}
+	return target
+}
+
+// addInvisibleWatermark embeds the generation ID by shifting the mean luminance of each grid cell to the
+// quantization lattice of the bit it carries.
+func addInvisibleWatermark(img *image.NRGBA, id string) error {
+	payload, err := getWatermarkPayload(id)
+	if err != nil {
+		return err
+	}
+
+	b := img.Bounds()
+	if b.Dx() < invisibleWatermarkGridSize || b.Dy() < invisibleWatermarkGridSize {
+		return nil
+	}
+	for i := 0; i < invisibleWatermarkGridSize*invisibleWatermarkGridSize; i++ {
+		r := getWatermarkCell(b, i)
+		mean, ok := getCellMeanLuminance(img, r)
+		if !ok {
+			continue
+		}
+		target := getWatermarkTarget(mean, payload[i%len(payload)] != isWatermarkCellFlipped(i))
+
+		// Pixels which get clipped shift the mean less, so the remaining difference is applied again.
+		for iter := 0; iter < 4 && math.Abs(target-mean) > 0.25; iter++ {
+			shift := target - mean
+			for y := r.Min.Y; y < r.Max.Y; y++ {
+				for x := r.Min.X; x < r.Max.X; x++ {
+					p := img.Pix[img.PixOffset(x, y):]
+					if p[3] == 0 {
+						continue
+					}
+					for c := 0; c < 3; c++ {
+						p[c] = uint8(max(0, min(255, math.Round(float64(p[c])+shift))))
+					}
+				}
+			}
+			mean, _ = getCellMeanLuminance(img, r)
+		}
+	}
+	return nil
+}
+
+// detectInvisibleWatermark returns the generation ID embedded in the image, or an empty string if there's
+// no watermark.
+func detectInvisibleWatermark(data []byte) string {
+	src, _, err := decodeImage(data)
+	if err != nil {
+		return ""
+	}
+	b := src.Bounds()
+	if b.Dx() < invisibleWatermarkGridSize || b.Dy() < invisibleWatermarkGridSize {
+		return ""
+	}
+	img := image.NewNRGBA(b)
+	draw.Draw(img, b, src, b.Min, draw.Src)
+
+	votes := make([]int, invisibleWatermarkPayloadBits)
+	cells := 0
+	for i := 0; i < invisibleWatermarkGridSize*invisibleWatermarkGridSize; i++ {
+		mean, ok := getCellMeanLuminance(img, getWatermarkCell(b, i))
+		if !ok {
+			continue
+		}
+		cells++
+		r := math.Mod(mean, invisibleWatermarkStep)
+		bit := r >= invisibleWatermarkStep/4 && r < invisibleWatermarkStep*3/4
+		if bit != isWatermarkCellFlipped(i) {
+			votes[i%len(votes)]++
+		} else {
+			votes[i%len(votes)]--
+		}
+	}
+
+	payload := make([]byte, invisibleWatermarkPayloadBits/8)
+	agreeing := 0
+	for i, v := range votes {
+		if v > 0 {
+			payload[i/8] |= 1 << (7 - i%8)
+		}
+		agreeing += abs(v)
+	}
+	// Cells of images without a watermark vote randomly, so most of the votes cancel out.
+	if agreeing < cells*invisibleWatermarkMinAgreement/100 {
+		return ""
+	}
+	if byte(crc32.ChecksumIEEE(payload[:4])) != payload[4] || binary.BigEndian.Uint32(payload[:4]) == 0 {
+		return ""
+	}
+	return hex.EncodeToString(payload[:4])
+}
+
+// addWatermarks adds the watermarks configured for the chat to the given images.
+func addWatermarks(imgs [][]byte, chatID int64, genID string) ([][]byte, error) {
+	mode := getWatermarkMode(chatID)
+	if mode == watermarkOff {
+		return imgs, nil
+	}
+
+	res := make([][]byte, len(imgs))
+	for i, d := range imgs {
+		src, format, err := image.Decode(bytes.NewReader(d))
+		if err != nil {
+			return nil, err
+		}
+		img := image.NewNRGBA(src.Bounds())
+		draw.Draw(img, img.Bounds(), src, src.Bounds().Min, draw.Src)
+
+		if mode == watermarkVisible || mode == watermarkBoth {
+			watermarkHandler.addVisibleWatermark(img)
+		}
+		if mode == watermarkInvisible || mode == watermarkBoth {
+			if err := addInvisibleWatermark(img, genID); err != nil {
+				return nil, err
+			}
+		}
+		if res[i], err = encodeImage(img, format == "jpeg"); err != nil {
+			return nil, err
+		}
+	}
+	return res, nil
+}
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"bytes"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"math/rand"
+	"testing"
+)
+
+func newTestImage(w, h int, fn func(x, y int) color.NRGBA) []byte {
+	img := image.NewNRGBA(image.Rect(0, 0, w, h))
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			img.SetNRGBA(x, y, fn(x, y))
+		}
+	}
+	d, _ := encodeImage(img, false)
+	return d
+}
+
+func recompressJPEG(t *testing.T, data []byte, quality int) []byte {
+	img, _, err := image.Decode(bytes.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var buf bytes.Buffer
+	if err := jpeg.Encode(&buf, img, &jpeg.Options{Quality: quality}); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func resizeTestImage(t *testing.T, data []byte, w, h int) []byte {
+	img, _, err := image.Decode(bytes.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	d, err := encodeImage(resizeImage(img, w, h), false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return d
+}
+
+func TestInvisibleWatermarkRoundTrip(t *testing.T) {
+	params.Watermark = watermarkInvisible
+	defer func() { params.Watermark = "" }()
+
+	rnd := rand.New(rand.NewSource(1))
+	images := map[string][]byte{
+		"white": newTestImage(512, 512, func(x, y int) color.NRGBA { return color.NRGBA{255, 255, 255, 255} }),
+		"black": newTestImage(512, 512, func(x, y int) color.NRGBA { return color.NRGBA{0, 0, 0, 255} }),
+		"gray":  newTestImage(512, 512, func(x, y int) color.NRGBA { return color.NRGBA{128, 128, 128, 255} }),
+		"gradient": newTestImage(768, 512, func(x, y int) color.NRGBA {
+			return color.NRGBA{uint8(x / 3), uint8(y / 2), 128, 255}
+		}),
+		"noise": newTestImage(1024, 1024, func(x, y int) color.NRGBA {
+			return color.NRGBA{uint8(rnd.Intn(256)), uint8(rnd.Intn(256)), uint8(rnd.Intn(256)), 255}
+		}),
+		"transparent background": newTestImage(512, 512, func(x, y int) color.NRGBA {
+			if x < 128 || x >= 384 {
+				return color.NRGBA{}
+			}
+			return color.NRGBA{200, 40, 40, 255}
+		}),
+		"semi-transparent": newTestImage(512, 512, func(x, y int) color.NRGBA {
+			return color.NRGBA{40, 90, 200, 128}
+		}),
+	}
+
+	const genID = "1234abcd"
+	for name, d := range images {
+		res, err := addWatermarks([][]byte{d}, 0, genID)
+		if err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		if id := detectInvisibleWatermark(res[0]); id != genID {
+			t.Errorf("%s: detected %q, expected %q", name, id, genID)
+		}
+		if name == "transparent background" || name == "semi-transparent" {
+			continue
+		}
+		if id := detectInvisibleWatermark(recompressJPEG(t, res[0], 85)); id != genID {
+			t.Errorf("%s: detected %q after JPEG recompression, expected %q", name, id, genID)
+		}
+		b, _, _ := image.DecodeConfig(bytes.NewReader(res[0]))
+		if id := detectInvisibleWatermark(resizeTestImage(t, res[0], b.Width/2, b.Height/2)); id != genID {
+			t.Errorf("%s: detected %q after resizing, expected %q", name, id, genID)
+		}
+	}
+}
+
+func TestInvisibleWatermarkNotDetected(t *testing.T) {
+	rnd := rand.New(rand.NewSource(2))
+	images := map[string][]byte{
+		"white":       newTestImage(512, 512, func(x, y int) color.NRGBA { return color.NRGBA{255, 255, 255, 255} }),
+		"black":       newTestImage(512, 512, func(x, y int) color.NRGBA { return color.NRGBA{0, 0, 0, 255} }),
+		"transparent": newTestImage(512, 512, func(x, y int) color.NRGBA { return color.NRGBA{} }),
+		"noise": newTestImage(512, 512, func(x, y int) color.NRGBA {
+			return color.NRGBA{uint8(rnd.Intn(256)), uint8(rnd.Intn(256)), uint8(rnd.Intn(256)), 255}
+		}),
+	}
+	for name, d := range images {
+		if id := detectInvisibleWatermark(d); id != "" {
+			t.Errorf("%s: detected %q in an image without a watermark", name, id)
+		}
+	}
+}
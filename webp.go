@@ -0,0 +1,620 @@
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"image"
+	"image/draw"
+	"math/bits"
+	"sort"
+)
+
+// WebP images are encoded in the lossless (VP8L) format, with the subtract green and the predictor
+// transforms, and LZ77 backward references.
+// See https://developers.google.com/speed/webp/docs/webp_lossless_bitstream_specification
+
+const (
+	webpMaxDimension     = 16384
+	vp8lSignature        = 0x2f
+	vp8lNumLiterals      = 256
+	vp8lNumLengthCodes   = 24
+	vp8lNumDistanceCodes = 40
+	vp8lMaxCodeLength    = 15
+	vp8lMaxCodeLenCode   = 7 // Max. length of the code which encodes the code lengths.
+	vp8lMinMatch         = 3
+	vp8lMaxMatch         = 4096
+	vp8lPlaneCodes       = 120     // Distance codes up to this are 2D offsets, larger ones are linear distances.
+	vp8lMaxDistance      = 1048456 // The max. distance code is 1048576.
+	vp8lHashBits         = 16
+	vp8lPredictorBits    = 5 // Predictor modes are chosen for 32x32 blocks.
+
+	webpVP8XSize = 10
+	webpFlagXMP  = 0x04
+)
+
+// Predictor modes tried for each block.
+var vp8lPredictorModes = []int{1, 2, 3, 4, 7, 11, 12, 13}
+
+var vp8lCodeLengthCodeOrder = [19]int{17, 18, 0, 1, 2, 3, 4, 5, 16, 6, 7, 8, 9, 10, 11, 12, 13, 14, 15}
+
+type vp8lBitWriterType struct {
+	buf   []byte
+	acc   uint64
+	nbits uint
+}
+
+// write writes the lowest n bits of v, LSB first.
+func (w *vp8lBitWriterType) write(v uint32, n uint) {
+	w.acc |= uint64(v) << w.nbits
+	w.nbits += n
+	for w.nbits >= 8 {
+		w.buf = append(w.buf, byte(w.acc))
+		w.acc >>= 8
+		w.nbits -= 8
+	}
+}
+
+func (w *vp8lBitWriterType) flush() {
+	if w.nbits > 0 {
+		w.buf = append(w.buf, byte(w.acc))
+		w.acc = 0
+		w.nbits = 0
+	}
+}
+
+// vp8lHuffmanCodeType is a canonical prefix code. Codes are stored bit reversed, as they are written LSB first.
+type vp8lHuffmanCodeType struct {
+	lengths []uint32 // Code lengths written to the stream.
+	codes   []uint32
+	nbits   []uint // Written code lengths, 0 if the code has only one symbol.
+}
+
+// vp8lCodeLengths returns the Huffman code lengths for the given symbol frequencies, limited to maxLength.
+func vp8lCodeLengths(freqs []int, maxLength int) []uint32 {
+	lengths := make([]uint32, len(freqs))
+	var leaves []int
+	for s, f := range freqs {
+		if f > 0 {
+			leaves = append(leaves, s)
+		}
+	}
+	switch len(leaves) {
+	case 0:
+		return lengths
+	case 1:
+		lengths[leaves[0]] = 1
+		return lengths
+	}
+
+	f := make([]int, len(freqs))
+	copy(f, freqs)
+	n := len(leaves)
+	for {
+		sort.SliceStable(leaves, func(i, j int) bool { return f[leaves[i]] < f[leaves[j]] })
+
+		// The first n nodes are the leaves, followed by the internal nodes in the order of creation, which is
+		// also the order of their frequencies, so the two smallest nodes are always at the front of the lists.
+		freq := make([]int, 2*n-1)
+		parent := make([]int, 2*n-1)
+		for i, s := range leaves {
+			freq[i] = f[s]
+		}
+		nextLeaf, nextNode := 0, n
+		for k := n; k < 2*n-1; k++ {
+			for j := 0; j < 2; j++ {
+				var m int
+				if nextLeaf < n && (nextNode >= k || freq[nextLeaf] <= freq[nextNode]) {
+					m = nextLeaf
+					nextLeaf++
+				} else {
+					m = nextNode
+					nextNode++
+				}
+				freq[k] += freq[m]
+				parent[m] = k
+			}
+		}
+
+		depth := make([]int, 2*n-1)
+		maxDepth := 0
+		for k := 2*n - 3; k >= 0; k-- {
+			depth[k] = depth[parent[k]] + 1
+			maxDepth = max(maxDepth, depth[k])
+		}
+		if maxDepth <= maxLength {
+			for i, s := range leaves {
+				lengths[s] = uint32(depth[i])
+			}
+			return lengths
+		}
+
+		// Flattening the frequencies until the code fits.
+		for _, s := range leaves {
+			f[s] = max(1, f[s]/2)
+		}
+	}
+}
+
+func newVP8LHuffmanCode(freqs []int, maxLength int) vp8lHuffmanCodeType {
+	c := vp8lHuffmanCodeType{
+		lengths: vp8lCodeLengths(freqs, maxLength),
+		codes:   make([]uint32, len(freqs)),
+		nbits:   make([]uint, len(freqs)),
+	}
+
+	var count [vp8lMaxCodeLength + 1]uint32
+	used := 0
+	for _, l := range c.lengths {
+		if l > 0 {
+			count[l]++
+			used++
+		}
+	}
+	if used < 2 {
+		return c
+	}
+
+	var next [vp8lMaxCodeLength + 1]uint32
+	code := uint32(0)
+	for l := 1; l <= vp8lMaxCodeLength; l++ {
+		code = (code + count[l-1]) << 1
+		next[l] = code
+	}
+	for s, l := range c.lengths {
+		if l > 0 {
+			c.codes[s] = bits.Reverse32(next[l]) >> (32 - l)
+			c.nbits[s] = uint(l)
+			next[l]++
+		}
+	}
+	return c
+}
+
+func (c *vp8lHuffmanCodeType) writeSymbol(w *vp8lBitWriterType, s int) {
+	w.write(c.codes[s], c.nbits[s])
+}
+
+// writeTo writes the code lengths of the code.
+func (c *vp8lHuffmanCodeType) writeTo(w *vp8lBitWriterType) {
+	var symbols []int
+	for s, l := range c.lengths {
+		if l > 0 {
+			symbols = append(symbols, s)
+		}
+	}
+	if len(symbols) == 0 {
+		symbols = []int{0}
+	}
+
+	if len(symbols) <= 2 && symbols[len(symbols)-1] < vp8lNumLiterals {
+		// Simple code of 1 or 2 symbols.
+		w.write(1, 1)
+		w.write(uint32(len(symbols)-1), 1)
+		if symbols[0] < 2 {
+			w.write(0, 1)
+			w.write(uint32(symbols[0]), 1)
+		} else {
+			w.write(1, 1)
+			w.write(uint32(symbols[0]), 8)
+		}
+		if len(symbols) == 2 {
+			w.write(uint32(symbols[1]), 8)
+		}
+		return
+	}
+
+	// Normal code, the code lengths are run length encoded with codes 16 (repeat the previous length), 17 and
+	// 18 (repeat zero), and then encoded with another prefix code.
+	type tokenType struct {
+		code, extra int
+	}
+	var tokens []tokenType
+	for i := 0; i < len(c.lengths); {
+		l := int(c.lengths[i])
+		run := 1
+		for i+run < len(c.lengths) && int(c.lengths[i+run]) == l {
+			run++
+		}
+		i += run
+
+		if l == 0 {
+			for run >= 11 {
+				r := min(run, 138)
+				tokens = append(tokens, tokenType{18, r - 11})
+				run -= r
+			}
+			if run >= 3 {
+				tokens = append(tokens, tokenType{17, run - 3})
+				run = 0
+			}
+		} else {
+			tokens = append(tokens, tokenType{l, 0})
+			run--
+			for run >= 3 {
+				r := min(run, 6)
+				tokens = append(tokens, tokenType{16, r - 3})
+				run -= r
+			}
+		}
+		for ; run > 0; run-- {
+			tokens = append(tokens, tokenType{l, 0})
+		}
+	}
+
+	freqs := make([]int, len(vp8lCodeLengthCodeOrder))
+	for _, t := range tokens {
+		freqs[t.code]++
+	}
+	lc := newVP8LHuffmanCode(freqs, vp8lMaxCodeLenCode)
+
+	n := 4
+	for i, s := range vp8lCodeLengthCodeOrder {
+		if lc.lengths[s] > 0 {
+			n = max(n, i+1)
+		}
+	}
+	w.write(0, 1)
+	w.write(uint32(n-4), 4)
+	for _, s := range vp8lCodeLengthCodeOrder[:n] {
+		w.write(lc.lengths[s], 3)
+	}
+	w.write(0, 1) // All symbols of the alphabet are coded.
+	for _, t := range tokens {
+		lc.writeSymbol(w, t.code)
+		switch t.code {
+		case 16:
+			w.write(uint32(t.extra), 2)
+		case 17:
+			w.write(uint32(t.extra), 3)
+		case 18:
+			w.write(uint32(t.extra), 7)
+		}
+	}
+}
+
+// vp8lPrefixEncode returns the prefix code and the extra bits of the given length or distance value.
+func vp8lPrefixEncode(value int) (prefix int, extraBits uint, extra uint32) {
+	v := value - 1
+	if v < 4 {
+		return v, 0, 0
+	}
+	h := bits.Len(uint(v)) - 1
+	extraBits = uint(h - 1)
+	return 2*h + (v>>extraBits)&1, extraBits, uint32(v) & (1<<extraBits - 1)
+}
+
+func vp8lHash(p []uint32) uint32 {
+	return (p[0]*0x1e35a7bd ^ p[1]*0x9e3779b1 ^ p[2]*0x85ebca6b) >> (32 - vp8lHashBits)
+}
+
+// vp8lTokenType is a literal pixel, or a backward reference if length is not 0.
+type vp8lTokenType struct {
+	argb             uint32
+	length, distance int
+}
+
+// vp8lFindTokens finds backward references to the previous pixel, the pixel above, and the last position
+// with the same hash of the next pixels.
+func vp8lFindTokens(argb []uint32, width int) (tokens []vp8lTokenType) {
+	head := make([]int32, 1<<vp8lHashBits)
+	for i := range head {
+		head[i] = -1
+	}
+	insert := func(i int) {
+		if i+vp8lMinMatch <= len(argb) {
+			head[vp8lHash(argb[i:])] = int32(i)
+		}
+	}
+
+	for i := 0; i < len(argb); {
+		maxLength := min(vp8lMaxMatch, len(argb)-i)
+		bestLength, bestDistance := 0, 0
+		candidates := [3]int{i - 1, i - width, -1}
+		if maxLength >= vp8lMinMatch {
+			candidates[2] = int(head[vp8lHash(argb[i:])])
+		}
+		for _, c := range candidates {
+			if c < 0 || c >= i || i-c > vp8lMaxDistance {
+				continue
+			}
+			l := 0
+			for l < maxLength && argb[c+l] == argb[i+l] {
+				l++
+			}
+			if l > bestLength {
+				bestLength, bestDistance = l, i-c
+			}
+		}
+
+		if bestLength < vp8lMinMatch {
+			tokens = append(tokens, vp8lTokenType{argb: argb[i]})
+			insert(i)
+			i++
+			continue
+		}
+		tokens = append(tokens, vp8lTokenType{length: bestLength, distance: bestDistance})
+		for j := 0; j < bestLength; j++ {
+			insert(i + j)
+		}
+		i += bestLength
+	}
+	return
+}
+
+func abs(v int) int {
+	if v < 0 {
+		return -v
+	}
+	return v
+}
+
+// vp8lAverage2 returns the average of each channel of the given pixels.
+func vp8lAverage2(a, b uint32) uint32 {
+	return ((a^b)&0xfefefefe)>>1 + a&b
+}
+
+// vp8lSub subtracts the channels of the given pixels modulo 256.
+func vp8lSub(a, b uint32) uint32 {
+	return ((a|0x00ff00ff)-(b&0xff00ff00))&0xff00ff00 | ((a|0xff00ff00)-(b&0x00ff00ff))&0x00ff00ff
+}
+
+// vp8lClampAddSubtract returns a + (b - c) * num / den for each channel, clamped to 0..255.
+func vp8lClampAddSubtract(a, b, c uint32, num, den int) (res uint32) {
+	for s := 0; s < 32; s += 8 {
+		v := int(a>>s&0xff) + (int(b>>s&0xff)-int(c>>s&0xff))*num/den
+		res |= uint32(min(255, max(0, v))) << s
+	}
+	return
+}
+
+// vp8lPredict returns the prediction of the given predictor mode from the left, top, top-right and top-left
+// pixels.
+func vp8lPredict(mode int, l, t, tr, tl uint32) uint32 {
+	switch mode {
+	case 1:
+		return l
+	case 2:
+		return t
+	case 3:
+		return tr
+	case 4:
+		return tl
+	case 5:
+		return vp8lAverage2(vp8lAverage2(l, tr), t)
+	case 6:
+		return vp8lAverage2(l, tl)
+	case 7:
+		return vp8lAverage2(l, t)
+	case 8:
+		return vp8lAverage2(tl, t)
+	case 9:
+		return vp8lAverage2(t, tr)
+	case 10:
+		return vp8lAverage2(vp8lAverage2(l, tl), vp8lAverage2(t, tr))
+	case 11:
+		// Selecting the one of L and T which is closer to L + T - TL.
+		pl, pt := 0, 0
+		for s := 0; s < 32; s += 8 {
+			pl += abs(int(t>>s&0xff) - int(tl>>s&0xff))
+			pt += abs(int(l>>s&0xff) - int(tl>>s&0xff))
+		}
+		if pl < pt {
+			return l
+		}
+		return t
+	case 12:
+		return vp8lClampAddSubtract(l, t, tl, 1, 1)
+	case 13:
+		a := vp8lAverage2(l, t)
+		return vp8lClampAddSubtract(a, a, tl, 1, 2)
+	}
+	return 0xff000000
+}
+
+// vp8lPredictPixel returns the prediction of the given pixel. The first row is predicted from the left, the
+// first column from the top pixels. The top-right pixel of the last column is the first pixel of the row.
+func vp8lPredictPixel(argb []uint32, width, x, y, mode int) uint32 {
+	i := y*width + x
+	switch {
+	case x == 0 && y == 0:
+		return 0xff000000
+	case y == 0:
+		return argb[i-1]
+	case x == 0:
+		return argb[i-width]
+	}
+	return vp8lPredict(mode, argb[i-1], argb[i-width], argb[i-width+1], argb[i-width-1])
+}
+
+// vp8lApplyPredictor selects the predictor mode with the smallest residuals for each block. Returns the
+// modes (in the green channel of the pixels of the subresolution image), and the residuals.
+func vp8lApplyPredictor(argb []uint32, width, height int) (modes []uint32, residuals []uint32) {
+	blockSize := 1 << vp8lPredictorBits
+	blocksPerRow := (width + blockSize - 1) >> vp8lPredictorBits
+	blocksPerCol := (height + blockSize - 1) >> vp8lPredictorBits
+	modes = make([]uint32, blocksPerRow*blocksPerCol)
+	residuals = make([]uint32, len(argb))
+
+	for by := 0; by < blocksPerCol; by++ {
+		for bx := 0; bx < blocksPerRow; bx++ {
+			x0, y0 := bx*blockSize, by*blockSize
+			x1, y1 := min(width, x0+blockSize), min(height, y0+blockSize)
+
+			bestMode, bestCost := 0, -1
+			for _, mode := range vp8lPredictorModes {
+				cost := 0
+				for y := y0; y < y1; y++ {
+					for x := x0; x < x1; x++ {
+						r := vp8lSub(argb[y*width+x], vp8lPredictPixel(argb, width, x, y, mode))
+						for s := 0; s < 32; s += 8 {
+							v := int(r >> s & 0xff)
+							cost += min(v, 256-v)
+						}
+					}
+				}
+				if bestCost < 0 || cost < bestCost {
+					bestMode, bestCost = mode, cost
+				}
+			}
+
+			modes[by*blocksPerRow+bx] = 0xff000000 | uint32(bestMode)<<8
+			for y := y0; y < y1; y++ {
+				for x := x0; x < x1; x++ {
+					residuals[y*width+x] = vp8lSub(argb[y*width+x], vp8lPredictPixel(argb, width, x, y, bestMode))
+				}
+			}
+		}
+	}
+	return
+}
+
+// vp8lWriteImage writes an entropy coded image. Only the main image can have meta prefix codes.
+func vp8lWriteImage(w *vp8lBitWriterType, argb []uint32, width int, isMain bool) {
+	tokens := vp8lFindTokens(argb, width)
+
+	greenFreqs := make([]int, vp8lNumLiterals+vp8lNumLengthCodes)
+	redFreqs := make([]int, vp8lNumLiterals)
+	blueFreqs := make([]int, vp8lNumLiterals)
+	alphaFreqs := make([]int, vp8lNumLiterals)
+	distanceFreqs := make([]int, vp8lNumDistanceCodes)
+	for _, t := range tokens {
+		if t.length == 0 {
+			greenFreqs[t.argb>>8&0xff]++
+			redFreqs[t.argb>>16&0xff]++
+			blueFreqs[t.argb&0xff]++
+			alphaFreqs[t.argb>>24]++
+			continue
+		}
+		l, _, _ := vp8lPrefixEncode(t.length)
+		greenFreqs[vp8lNumLiterals+l]++
+		d, _, _ := vp8lPrefixEncode(t.distance + vp8lPlaneCodes)
+		distanceFreqs[d]++
+	}
+	green := newVP8LHuffmanCode(greenFreqs, vp8lMaxCodeLength)
+	red := newVP8LHuffmanCode(redFreqs, vp8lMaxCodeLength)
+	blue := newVP8LHuffmanCode(blueFreqs, vp8lMaxCodeLength)
+	alpha := newVP8LHuffmanCode(alphaFreqs, vp8lMaxCodeLength)
+	distance := newVP8LHuffmanCode(distanceFreqs, vp8lMaxCodeLength)
+
+	w.write(0, 1) // No color cache.
+	if isMain {
+		w.write(0, 1) // No meta prefix codes.
+	}
+	for _, c := range []*vp8lHuffmanCodeType{&green, &red, &blue, &alpha, &distance} {
+		c.writeTo(w)
+	}
+
+	for _, t := range tokens {
+		if t.length == 0 {
+			green.writeSymbol(w, int(t.argb>>8&0xff))
+			red.writeSymbol(w, int(t.argb>>16&0xff))
+			blue.writeSymbol(w, int(t.argb&0xff))
+			alpha.writeSymbol(w, int(t.argb>>24))
+			continue
+		}
+		l, lBits, lExtra := vp8lPrefixEncode(t.length)
+		green.writeSymbol(w, vp8lNumLiterals+l)
+		w.write(lExtra, lBits)
+		d, dBits, dExtra := vp8lPrefixEncode(t.distance + vp8lPlaneCodes)
+		distance.writeSymbol(w, d)
+		w.write(dExtra, dBits)
+	}
+}
+
+// encodeWebP encodes the image as a lossless WebP.
+func encodeWebP(img image.Image) ([]byte, error) {
+	b := img.Bounds()
+	width, height := b.Dx(), b.Dy()
+	if width == 0 || height == 0 || width > webpMaxDimension || height > webpMaxDimension {
+		return nil, fmt.Errorf("can't encode %dx%d image as WebP, max. size is %dpx", width, height, webpMaxDimension)
+	}
+
+	src := image.NewNRGBA(image.Rect(0, 0, width, height))
+	draw.Draw(src, src.Bounds(), img, b.Min, draw.Src)
+
+	// Applying the subtract green transform.
+	argb := make([]uint32, width*height)
+	hasAlpha := false
+	for i := range argb {
+		p := src.Pix[i*4 : i*4+4]
+		r, g, b, a := p[0]-p[1], p[1], p[2]-p[1], p[3]
+		argb[i] = uint32(a)<<24 | uint32(r)<<16 | uint32(g)<<8 | uint32(b)
+		hasAlpha = hasAlpha || a != 0xff
+	}
+	modes, residuals := vp8lApplyPredictor(argb, width, height)
+
+	var w vp8lBitWriterType
+	w.write(vp8lSignature, 8)
+	w.write(uint32(width-1), 14)
+	w.write(uint32(height-1), 14)
+	if hasAlpha {
+		w.write(1, 1)
+	} else {
+		w.write(0, 1)
+	}
+	w.write(0, 3) // Version.
+	// The decoder undoes the transforms in reverse order.
+	w.write(1, 1) // Transform present.
+	w.write(2, 2) // Subtract green transform.
+	w.write(1, 1) // Transform present.
+	w.write(0, 2) // Predictor transform.
+	w.write(vp8lPredictorBits-2, 3)
+	vp8lWriteImage(&w, modes, (width+1<<vp8lPredictorBits-1)>>vp8lPredictorBits, false)
+	w.write(0, 1) // No more transforms.
+	vp8lWriteImage(&w, residuals, width, true)
+	w.flush()
+
+	return webpContainer([]webpChunkType{{"VP8L", w.buf}}), nil
+}
+
+type webpChunkType struct {
+	fourCC string
+	data   []byte
+}
+
+// webpContainer returns the RIFF container with the given chunks.
+func webpContainer(chunks []webpChunkType) []byte {
+	size := 4
+	for _, c := range chunks {
+		size += 8 + len(c.data) + len(c.data)&1
+	}
+	res := make([]byte, 0, 8+size)
+	res = append(res, "RIFF"...)
+	res = binary.LittleEndian.AppendUint32(res, uint32(size))
+	res = append(res, "WEBP"...)
+	for _, c := range chunks {
+		res = append(res, c.fourCC...)
+		res = binary.LittleEndian.AppendUint32(res, uint32(len(c.data)))
+		res = append(res, c.data...)
+		if len(c.data)&1 != 0 {
+			res = append(res, 0) // Chunks are padded to even sizes.
+		}
+	}
+	return res
+}
+
+func isWebP(data []byte) bool {
+	return len(data) >= 12 && string(data[:4]) == "RIFF" && string(data[8:12]) == "WEBP"
+}
+
+// parseWebPChunks returns the chunks of the RIFF container.
+func parseWebPChunks(data []byte) (chunks []webpChunkType, ok bool) {
+	if !isWebP(data) {
+		return nil, false
+	}
+	for pos := 12; pos+8 <= len(data); {
+		size := int(binary.LittleEndian.Uint32(data[pos+4:]))
+		if pos+8+size > len(data) {
+			return nil, false
+		}
+		chunks = append(chunks, webpChunkType{string(data[pos : pos+4]), data[pos+8 : pos+8+size]})
+		pos += 8 + size + size&1
+	}
+	return chunks, true
+}
+
+func putUint24LE(b []byte, v uint32) {
+	b[0] = byte(v)
+	b[1] = byte(v >> 8)
+	b[2] = byte(v >> 16)
+}
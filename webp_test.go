@@ -0,0 +1,95 @@
+package main
+
+import (
+	"bytes"
+	"image"
+	"image/color"
+	"image/draw"
+	"math/rand"
+	"testing"
+
+	"golang.org/x/image/webp"
+)
+
+func TestWebPRoundTrip(t *testing.T) {
+	rnd := rand.New(rand.NewSource(1))
+	tests := []struct {
+		name          string
+		width, height int
+		fn            func(x, y int) color.NRGBA
+	}{
+		{"single pixel", 1, 1, func(x, y int) color.NRGBA { return color.NRGBA{10, 20, 30, 255} }},
+		{"uniform", 64, 64, func(x, y int) color.NRGBA { return color.NRGBA{200, 100, 50, 255} }},
+		{"odd size gradient", 33, 65, func(x, y int) color.NRGBA {
+			return color.NRGBA{uint8(x * 7), uint8(y * 3), uint8(x + y), 255}
+		}},
+		{"wide gradient", 301, 7, func(x, y int) color.NRGBA {
+			return color.NRGBA{uint8(x), uint8(255 - x), uint8(y * 30), 255}
+		}},
+		{"stripes", 97, 131, func(x, y int) color.NRGBA {
+			if (x/5+y/3)%2 == 0 {
+				return color.NRGBA{0, 0, 0, 255}
+			}
+			return color.NRGBA{255, 255, 255, 255}
+		}},
+		{"repeating tiles", 517, 300, func(x, y int) color.NRGBA {
+			return color.NRGBA{uint8((x % 37) * 7), uint8((y % 23) * 11), uint8((x * y) % 13), 255}
+		}},
+		{"noise", 129, 71, func(x, y int) color.NRGBA {
+			return color.NRGBA{uint8(rnd.Intn(256)), uint8(rnd.Intn(256)), uint8(rnd.Intn(256)), 255}
+		}},
+		{"noise with alpha", 75, 53, func(x, y int) color.NRGBA {
+			return color.NRGBA{uint8(rnd.Intn(256)), uint8(rnd.Intn(256)), uint8(rnd.Intn(256)), uint8(rnd.Intn(256))}
+		}},
+		{"transparent background", 90, 45, func(x, y int) color.NRGBA {
+			if x < 30 || x >= 60 {
+				return color.NRGBA{}
+			}
+			return color.NRGBA{uint8(x * 4), 40, uint8(y * 5), 255}
+		}},
+		{"alpha gradient", 40, 200, func(x, y int) color.NRGBA {
+			return color.NRGBA{120, uint8(x * 6), 30, uint8(y)}
+		}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			img := image.NewNRGBA(image.Rect(0, 0, tt.width, tt.height))
+			for y := 0; y < tt.height; y++ {
+				for x := 0; x < tt.width; x++ {
+					img.SetNRGBA(x, y, tt.fn(x, y))
+				}
+			}
+
+			d, err := encodeWebP(img)
+			if err != nil {
+				t.Fatal(err)
+			}
+			decoded, err := webp.Decode(bytes.NewReader(d))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if decoded.Bounds() != img.Bounds() {
+				t.Fatalf("decoded size is %v, expected %v", decoded.Bounds(), img.Bounds())
+			}
+			res := image.NewNRGBA(decoded.Bounds())
+			draw.Draw(res, res.Bounds(), decoded, image.Point{}, draw.Src)
+			for y := 0; y < tt.height; y++ {
+				for x := 0; x < tt.width; x++ {
+					// Colors of fully transparent pixels are not kept by the decoder.
+					if c := img.NRGBAAt(x, y); c.A != 0 && res.NRGBAAt(x, y) != c {
+						t.Fatalf("pixel at %d,%d is %v, expected %v", x, y, res.NRGBAAt(x, y), c)
+					}
+				}
+			}
+		})
+	}
+}
+
+func TestWebPTooLarge(t *testing.T) {
+	for _, r := range []image.Rectangle{image.Rect(0, 0, 0, 10), image.Rect(0, 0, webpMaxDimension+1, 1)} {
+		if _, err := encodeWebP(image.NewNRGBA(r)); err == nil {
+			t.Errorf("%v: expected an error", r)
+		}
+	}
+}